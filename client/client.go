@@ -2,16 +2,25 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"../common"
 )
 
 const (
@@ -19,9 +28,10 @@ const (
 	kTXModeParallel
 	kTXModePersistent
 	kTXModePipelined
+	kTXModeMultiplexed
 )
 
-var TXModeStrings = [4]string{"single", "parallel", "persistent", "pipelined"}
+var TXModeStrings = [5]string{"single", "parallel", "persistent", "pipelined", "multiplexed"}
 
 const (
 	kGetWaitOK = iota
@@ -34,25 +44,89 @@ const (
 var (
 	Host         string
 	Port         string
-	ServerAddr   *net.TCPAddr
+	ServerAddr   net.Addr
+	UseTLS       bool
+	Framing      string
+	TLSConfig    *tls.Config
 	ValidEP      bool
 	TestMode     string
 	TxMode       int
 	MaxParallel  int
+	RateLimit    int64
+	RateBucket   *common.TokenBucket
+	Dedup        bool
 	UIMutex      sync.Mutex
 	NetWorkerWG  sync.WaitGroup
 	ConnLimitSem chan int
 )
 
 func InitFlags() {
-	flag.StringVar(&Host, "host", "localhost", "Hostname or IP address to connect to.")
+	flag.StringVar(&Host, "host", "localhost", "Hostname or IP address to connect to, or unix:<path> for a server's local socket.")
 	flag.StringVar(&Port, "port", "65500", "Port to connect to. May be specified as a number or protocol identifier.")
-	flag.StringVar(&TestMode, "run", "interactive", "Non-interactive mode: single, parallel, persistent or pipelined. Other values will run an interactive shell.")
+	flag.StringVar(&TestMode, "run", "interactive", "Non-interactive mode: single, parallel, persistent, pipelined or multiplexed. Other values will run an interactive shell.")
 	flag.IntVar(&MaxParallel, "climit", 65535, "The maximum number of connections in parallel mode.")
+	flag.StringVar(&UploadDir, "upload-dir", "", "Run as a daemon that watches this directory and uploads new and changed files, instead of the interactive shell. Uses the transfer mode given by -run.")
+	flag.StringVar(&UploadState, "upload-state", ".tcpft-upload-state", "File, relative to -upload-dir, recording what has been uploaded so restarts only send changes.")
+	flag.DurationVar(&UploadDelay, "upload-delay", 2*time.Second, "How long the upload directory must be quiet before changes are uploaded.")
+	flag.BoolVar(&Dedup, "dedup", false, "Offer each file to the server by checksum before uploading it, skipping the upload if the server already has the contents.")
+	flag.StringVar(&HashCacheFile, "hash-cache", ".tcpft-hashes", "File recording the checksums of local files, so unchanged local copies are not read again before a conditional GET. Empty keeps them in memory only.")
+	flag.StringVar(&Framing, "framing", "text", "Wire format of multiplexed connections: text, or binary for length-prefixed frames if the server agrees.")
+	flag.BoolVar(&UseTLS, "tls", false, "Connect to the server with TLS.")
+	tlsCA := flag.String("tls-ca", "", "PEM file of certificate authorities to trust for TLS instead of the system's, e.g. a server's self-signed certificate.")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file to present to a server that requires client certificates.")
+	tlsKey := flag.String("tls-key", "", "PEM private key file for -tls-cert.")
+	rateLimit := flag.String("limit-rate", "0", "Maximum transfer rate in bytes per second, shared by all connections, e.g. 512k or 10M. 0 is unlimited.")
+	bufferSize := flag.String("buffer-size", "256k", "Size of the buffer file contents are copied through, e.g. 64k or 1M.")
 	flag.Parse()
+
+	rate, error := common.ParseRate(*rateLimit)
+	if error != nil {
+		fmt.Println("Error parsing limit-rate:", error)
+		os.Exit(1)
+	}
+	RateLimit = rate
+	RateBucket = new(common.TokenBucket)
+	RateBucket.SetRate(RateLimit)
+
+	if Framing != "text" && Framing != "binary" {
+		fmt.Println("Unknown framing:", Framing)
+		os.Exit(1)
+	}
+
+	size, error := common.ParseRate(*bufferSize)
+	if error != nil || size < 4096 || size > 64<<20 {
+		fmt.Println("Error parsing buffer-size: must be between 4k and 64M")
+		os.Exit(1)
+	}
+	common.BufferSize = int(size)
+
+	TLSConfig = &tls.Config{}
+	if *tlsCA != "" {
+		pem, error := ioutil.ReadFile(*tlsCA)
+		if error != nil {
+			fmt.Println("Error reading tls-ca:", error)
+			os.Exit(1)
+		}
+		TLSConfig.RootCAs = x509.NewCertPool()
+		if !TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			fmt.Println("No certificates found in", *tlsCA)
+			os.Exit(1)
+		}
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		certificate, error := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if error != nil {
+			fmt.Println("Error loading TLS certificate:", error)
+			os.Exit(1)
+		}
+		TLSConfig.Certificates = []tls.Certificate{certificate}
+	}
 }
 
-func ParseGetResponse(filename string, reader *bufio.Reader) {
+// ParseGetResponse reads one GET response for filename from reader and stores
+// the body in a local file of the same name. It returns true if the file
+// was received intact.
+func ParseGetResponse(filename string, reader *bufio.Reader) bool {
 
 	parserState := kGetWaitOK
 	temp := make([]string, 0)
@@ -62,7 +136,7 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 		line, prefix, error := reader.ReadLine()
 		if error != nil {
 			fmt.Println("Connection terminated:", error)
-			return
+			return false
 		}
 		temp = append(temp, string(line))
 		if prefix {
@@ -78,7 +152,7 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 		case "REQERR":
 
 			fmt.Println("Request Error.")
-			return
+			return false
 
 		case "NOTFOUND":
 
@@ -87,7 +161,16 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 			} else {
 				fmt.Println("File", input[1], "was not found on the server.")
 			}
-			return
+			return false
+
+		case "NOTMODIFIED":
+
+			if len(input) < 2 {
+				fmt.Println("Connection error, invalid response format.")
+				return false
+			}
+			fmt.Println("File", input[1], "is up to date.")
+			return true
 
 		case "READERR":
 
@@ -96,16 +179,16 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 			} else {
 				fmt.Println("Unable to read file", input[1]+".")
 			}
-			return
+			return false
 
 		case "OK":
 
 			if len(input) < 2 {
 				fmt.Println("Connection error, invalid response format.")
-				return
+				return false
 			} else if input[1] != filename {
 				fmt.Println("Unexpected file", input[1]+", was expecting", filename)
-				return
+				return false
 			} else {
 				parserState = kGetWaitLength
 			}
@@ -120,7 +203,7 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 		line, prefix, error := reader.ReadLine()
 		if error != nil {
 			fmt.Println("Connection terminated:", error)
-			return
+			return false
 		}
 		temp = append(temp, string(line))
 		if prefix {
@@ -137,7 +220,7 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 
 			if len(input) < 2 {
 				fmt.Println("Connection error, invalid response format.")
-				return
+				return false
 			} else {
 				rxLength, error = strconv.ParseInt(input[1], 10, 64)
 				if error != nil {
@@ -157,54 +240,35 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 
 	}
 
-	var count int64
 	var localFile string
-	checksum := md5.New()
+	var receivedChecksum string
+	var writeError error
 
 	for parserState == kGetRecvData {
 
-		buffer := make([]byte, 1024)
-
 		localFile = filename + "-part"
 
+		// The body is read to its end even if it cannot be stored, so the
+		// connection stays in step with the server.
+		var dest io.Writer = io.Discard
 		file, error := os.Create(localFile)
 		if error != nil {
-
-			fmt.Println("Error creating", filename, ":", error)
-			return
-
+			writeError = error
+		} else {
+			dest = file
+			defer file.Close()
 		}
-		defer file.Close()
-
-		for count < rxLength-1024 {
-
-			readBytes, error := reader.Read(buffer)
-			if error != nil {
-				fmt.Println("Connection terminated:", error)
-				return
-			}
-
-			count += int64(readBytes)
-			checksum.Write(buffer[:readBytes])
-			file.Write(buffer[:readBytes])
 
+		checksum, receiveError, error := common.ReceiveBody(reader, dest, rxLength, RateBucket)
+		if error != nil {
+			fmt.Println("Connection terminated:", error)
+			os.Remove(localFile)
+			return false
 		}
-
-		smallBuffer := make([]byte, 1)
-
-		for count < rxLength {
-
-			readBytes, error := reader.Read(smallBuffer)
-			if error != nil {
-				fmt.Println("Connection terminated:", error)
-				return
-			}
-
-			count += int64(readBytes)
-			checksum.Write(smallBuffer[:readBytes])
-			file.Write(smallBuffer[:readBytes])
-
+		if writeError == nil {
+			writeError = receiveError
 		}
+		receivedChecksum = checksum
 
 		parserState = kGetChecksum
 	}
@@ -214,7 +278,7 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 		line, prefix, error := reader.ReadLine()
 		if error != nil {
 			fmt.Println("Connection terminated:", error)
-			return
+			return false
 		}
 
 		temp = append(temp, string(line))
@@ -233,7 +297,7 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 			if len(input) < 2 {
 
 				fmt.Println("Connection error, invalid response format.")
-				return
+				return false
 
 			} else {
 
@@ -245,10 +309,10 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 			continue
 		}
 
-		if inputChecksum != fmt.Sprintf("%x", checksum.Sum(make([]byte, 0))) {
+		if inputChecksum != receivedChecksum {
 
-			fmt.Println("Hash mismatch: server claimed", inputChecksum+", received", fmt.Sprintf("%x", checksum.Sum(make([]byte, 0)))+".")
-			return
+			fmt.Println("Hash mismatch: server claimed", inputChecksum+", received", receivedChecksum+".")
+			return false
 
 		}
 
@@ -257,8 +321,29 @@ func ParseGetResponse(filename string, reader *bufio.Reader) {
 	}
 
 	// parserState == kGetDone
-	fmt.Println("Wrote", strconv.FormatInt(count, 10), "bytes to file", filename+".")
+	if writeError != nil {
+		fmt.Println("Error writing", filename+":", writeError)
+		os.Remove(localFile)
+		return false
+	}
+
+	fmt.Println("Wrote", strconv.FormatInt(rxLength, 10), "bytes to file", filename+".")
 	os.Rename(localFile, filename)
+	RememberChecksum(filename, receivedChecksum)
+	return true
+
+}
+
+// GetRequestLine returns the GET request line for filename. If there is a
+// local copy its checksum is sent too, so the server only sends the file if
+// it differs.
+func GetRequestLine(filename string) string {
+
+	checksum := CachedChecksum(filename)
+	if checksum == "" {
+		return "GET " + filename + "\n"
+	}
+	return "GET " + filename + " IF-NONE-MATCH " + checksum + "\n"
 
 }
 
@@ -267,7 +352,7 @@ func GetRequest(filenames []string, pipelined bool) {
 	ConnLimitSem <- 1
 
 	fmt.Println("Getting", filenames, "Pipelined:", pipelined)
-	connx, error := net.DialTCP("tcp", nil, ServerAddr)
+	connx, error := DialServer()
 	if error != nil {
 		fmt.Println("Error connecting to server:", error)
 		NetWorkerWG.Done()
@@ -282,7 +367,7 @@ func GetRequest(filenames []string, pipelined bool) {
 	if pipelined {
 
 		for i := 0; i < len(filenames); i++ {
-			writer.WriteString("GET " + filenames[i] + "\n")
+			writer.WriteString(GetRequestLine(filenames[i]))
 		}
 
 		writer.WriteString("\n")
@@ -295,7 +380,7 @@ func GetRequest(filenames []string, pipelined bool) {
 	} else {
 
 		for i := 0; i < len(filenames); i++ {
-			writer.WriteString("GET " + filenames[i] + "\n\n")
+			writer.WriteString(GetRequestLine(filenames[i]) + "\n")
 			writer.Flush()
 			ParseGetResponse(filenames[i], reader)
 		}
@@ -311,10 +396,17 @@ func GetRequest(filenames []string, pipelined bool) {
 }
 
 func GetIndex() (filenames []string) {
+	return GetListing("GET \n\n", "", "index")
+}
+
+// GetListing sends request on a new connection and returns the lines of the
+// listing the server sends back as "OK <name>". description names the
+// listing in error messages.
+func GetListing(request string, name string, description string) (lines []string) {
 
 	remoteFiles := make([]string, 0)
 
-	connx, error := net.DialTCP("tcp", nil, ServerAddr)
+	connx, error := DialServer()
 	if error != nil {
 		fmt.Println("Error connecting to server:", error)
 		return
@@ -324,7 +416,7 @@ func GetIndex() (filenames []string) {
 	writer := bufio.NewWriter(connx)
 	defer connx.Close()
 
-	writer.WriteString("GET \n\n")
+	writer.WriteString(request)
 	writer.Flush()
 
 	parserState := kGetWaitOK
@@ -362,8 +454,8 @@ func GetIndex() (filenames []string) {
 			if len(input) < 2 {
 				fmt.Println("Connection error, invalid response format.")
 				return
-			} else if input[1] != "" {
-				fmt.Println("Unexpected file", input[1]+", was expecting index.")
+			} else if input[1] != name {
+				fmt.Println("Unexpected file", input[1]+", was expecting "+description+".")
 				return
 			} else {
 				parserState = kGetWaitLength
@@ -420,43 +512,19 @@ func GetIndex() (filenames []string) {
 
 	}
 
-	var count int64
-	checksum := md5.New()
-	listBuffer := make([]byte, rxLength)
+	var listing bytes.Buffer
+	var receivedChecksum string
 
 	for parserState == kGetRecvData {
 
-		buffer := make([]byte, 1024)
-
-		for count < rxLength-1024 {
-
-			readBytes, error := reader.Read(buffer)
-			if error != nil {
-				fmt.Println("Connection terminated:", error)
-				return
-			}
-
-			copy(listBuffer[count:], buffer[:readBytes])
-			count += int64(readBytes)
-			checksum.Write(buffer[:readBytes])
-
-		}
-
-		smallBuffer := make([]byte, 1)
-
-		for count < rxLength {
-
-			readBytes, error := reader.Read(smallBuffer)
-			if error != nil {
-				fmt.Println("Connection terminated:", error)
-				return
-			}
-
-			copy(listBuffer[count:], smallBuffer[:readBytes])
-			count += int64(readBytes)
-			checksum.Write(smallBuffer[:readBytes])
+		listing.Grow(int(rxLength))
 
+		checksum, _, error := common.ReceiveBody(reader, &listing, rxLength, RateBucket)
+		if error != nil {
+			fmt.Println("Connection terminated:", error)
+			return
 		}
+		receivedChecksum = checksum
 
 		parserState = kGetChecksum
 	}
@@ -497,9 +565,9 @@ func GetIndex() (filenames []string) {
 			continue
 		}
 
-		if inputChecksum != fmt.Sprintf("%x", checksum.Sum(make([]byte, 0))) {
+		if inputChecksum != receivedChecksum {
 
-			fmt.Println("Hash mismatch: server claimed", inputChecksum+", received", fmt.Sprintf("%x", checksum.Sum(make([]byte, 0)))+".")
+			fmt.Println("Hash mismatch: server claimed", inputChecksum+", received", receivedChecksum+".")
 			return
 
 		}
@@ -511,8 +579,7 @@ func GetIndex() (filenames []string) {
 	// parserState == kGetDone
 	writer.WriteString("BYE\n")
 	writer.Flush()
-	tempString := string(listBuffer)
-	remoteFiles = strings.Split(tempString, "\n")
+	remoteFiles = strings.Split(listing.String(), "\n")
 
 	return remoteFiles
 
@@ -549,11 +616,18 @@ func GetFiles(filenames []string) {
 		go GetRequest(filenames, TxMode == kTXModePipelined)
 		NetWorkerWG.Wait()
 
+	case kTXModeMultiplexed:
+
+		NetWorkerWG.Add(1)
+		go MuxGetRequest(filenames)
+		NetWorkerWG.Wait()
+
 	}
 
 	dur := time.Since(timeStart)
 	fmt.Println("Took", dur, "to get files.")
 
+	SaveHashCache()
 	UIMutex.Unlock()
 
 }
@@ -569,7 +643,247 @@ func GetAll() {
 
 }
 
-func PutRequestSend(filename string, writer *bufio.Writer) bool {
+// SyncAll downloads every file in the server's manifest whose local copy is
+// missing or differs, creating directories as needed. Files that are
+// already identical are not requested at all, and names that would be
+// written outside the working directory are skipped.
+func SyncAll() {
+
+	lines := GetListing("MANIFEST\n\n", "", "manifest")
+	if lines == nil {
+		fmt.Println("Unable to fetch the manifest, nothing was synced.")
+		UIMutex.Unlock()
+		return
+	}
+
+	wanted := make([]string, 0)
+	current := 0
+
+	for i := 0; i < len(lines); i++ {
+
+		fields := strings.SplitN(lines[i], " ", 3)
+		if len(fields) < 3 {
+			continue
+		}
+
+		if !localName(fields[2]) {
+			fmt.Println("Skipping", fields[2]+", which is not a relative name.")
+			continue
+		}
+
+		if CachedChecksum(fields[2]) == fields[0] {
+			current++
+			continue
+		}
+
+		if dir := filepath.Dir(fields[2]); dir != "." {
+			os.MkdirAll(dir, 0755)
+		}
+		wanted = append(wanted, fields[2])
+
+	}
+
+	fmt.Println(current, "files up to date,", len(wanted), "to fetch.")
+
+	if len(wanted) > 0 {
+		GetFiles(wanted)
+	} else {
+		SaveHashCache()
+		UIMutex.Unlock()
+	}
+
+}
+
+// localName reports whether a name sent by the server can be used as a
+// local path: relative, and with no ".." component to climb out of the
+// working directory.
+func localName(name string) bool {
+
+	if name == "" || strings.HasPrefix(name, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return false
+	}
+
+	components := strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' })
+	for i := 0; i < len(components); i++ {
+		if components[i] == ".." {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// PutCondition controls what the server does when a PUT names a file that
+// already exists. The zero value always replaces it.
+type PutCondition struct {
+	CreateOnly bool
+	IfMatch    string
+}
+
+// RestoreVersion downloads revision version of filename into the local file
+// of the same name, then uploads it so it becomes the server's current
+// contents again. The contents it replaces are kept as a new version.
+func RestoreVersion(filename string, version string) {
+
+	connx, error := DialServer()
+	if error != nil {
+		fmt.Println("Error connecting to server:", error)
+		UIMutex.Unlock()
+		return
+	}
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+
+	writer.WriteString("GET " + filename + " VERSION " + version + "\n\n")
+	writer.Flush()
+
+	success := ParseGetResponse(filename, reader)
+
+	writer.WriteString("BYE")
+	writer.Flush()
+	connx.Close()
+
+	if !success {
+		UIMutex.Unlock()
+		return
+	}
+
+	PutFiles([]string{filename}, PutCondition{})
+
+}
+
+// SimpleRequest sends a request that is answered by a single status line,
+// such as DELETE or UNDELETE, and returns that line split into words.
+func SimpleRequest(request string) []string {
+
+	connx, error := DialServer()
+	if error != nil {
+		fmt.Println("Error connecting to server:", error)
+		return nil
+	}
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+	defer connx.Close()
+
+	writer.WriteString(request + "\n\n")
+	writer.Flush()
+
+	for {
+
+		line, _, error := reader.ReadLine()
+		if error != nil {
+			fmt.Println("Connection terminated:", error)
+			return nil
+		}
+
+		if len(line) > 0 {
+			writer.WriteString("BYE\n")
+			writer.Flush()
+			return strings.Split(string(line), " ")
+		}
+
+	}
+
+}
+
+func PutRequestSend(filename string, writer *bufio.Writer, condition PutCondition) bool {
+	return PutRequestSendAs(filename, filename, writer, condition)
+}
+
+// PutRequestSendAs sends the local file localFile as a PUT of the remote
+// file name.
+func PutRequestSendAs(localFile string, name string, writer *bufio.Writer, condition PutCondition) bool {
+
+	fileInfo, error := os.Stat(localFile)
+	if error != nil || fileInfo.IsDir() {
+		fmt.Println("File", localFile, "not found.")
+		return false
+	}
+
+	file, error := os.Open(localFile)
+	if error != nil {
+		fmt.Println("Could not open", localFile+".")
+		return false
+	}
+	defer file.Close()
+
+	writer.WriteString("PUT " + name + "\n")
+	writer.WriteString("LENGTH " + strconv.FormatInt(fileInfo.Size(), 10) + "\n")
+	if condition.CreateOnly {
+		writer.WriteString("IF-NONE-MATCH *\n")
+	} else if condition.IfMatch != "" {
+		writer.WriteString("IF-MATCH " + condition.IfMatch + "\n")
+	}
+	writer.WriteString("\n")
+
+	// The file is sent with the length it had when the header was written,
+	// even if it has since grown.
+	sentBytes, checksum, error := common.SendBody(writer, io.LimitReader(file, fileInfo.Size()), RateBucket)
+	if error == nil && sentBytes < fileInfo.Size() {
+		error = io.ErrUnexpectedEOF
+	}
+	if error != nil {
+		fmt.Println("Error sending", localFile+":", error)
+		return false
+	}
+
+	writer.WriteString("\n\nCHECKSUM " + checksum + "\n\n")
+	writer.Flush()
+	return true
+
+}
+
+// ParsePutResponse reads and reports the server's reply to one PUT or LINK
+// and returns the response keyword, or "" if the connection failed.
+func ParsePutResponse(reader *bufio.Reader) string {
+
+	var input []string
+
+	for {
+
+		line, _, error := reader.ReadLine()
+		if error != nil {
+			fmt.Println("Connection terminated:", error)
+			return ""
+		}
+
+		input = strings.Split(string(line), " ")
+		if input[0] != "" {
+			break
+		}
+
+	}
+
+	if len(input) < 2 {
+		fmt.Println("Connection error, invalid response format.")
+		return strings.ToUpper(input[0])
+	}
+
+	switch strings.ToUpper(input[0]) {
+	case "RECV":
+		fmt.Println("Sent file", input[1]+".")
+	case "WRERR":
+		fmt.Println("Failed to write file", input[1]+".")
+	case "HASHERR":
+		fmt.Println("File", input[1], "was corrupted in transit.")
+	case "EXISTS":
+		fmt.Println("File", input[1], "already exists on the server, not replaced.")
+	case "CONFLICT":
+		fmt.Println("File", input[1], "changed on the server, not replaced.")
+	case "REJECTED":
+		fmt.Println("File", input[1], "was rejected by the server:", strings.Join(input[2:], " "))
+	}
+
+	return strings.ToUpper(input[0])
+
+}
+
+// PutLinkSend asks the server to store filename by reference to contents it
+// already holds, identified by SHA-256 and length, instead of uploading it.
+func PutLinkSend(filename string, writer *bufio.Writer, condition PutCondition) bool {
 
 	fileInfo, error := os.Stat(filename)
 	if error != nil || fileInfo.IsDir() {
@@ -585,36 +899,102 @@ func PutRequestSend(filename string, writer *bufio.Writer) bool {
 	defer file.Close()
 
 	checksum := md5.New()
+	digest := sha256.New()
+	_, error = io.Copy(io.MultiWriter(checksum, digest), file)
+	if error != nil {
+		fmt.Println("Could not read", filename+":", error)
+		return false
+	}
+
+	writer.WriteString("LINK " + filename + "\n")
+	writer.WriteString("LENGTH " + strconv.FormatInt(fileInfo.Size(), 10) + "\n")
+	writer.WriteString("CHECKSUM " + fmt.Sprintf("%x", checksum.Sum(make([]byte, 0))) + "\n")
+	writer.WriteString("SHA256 " + fmt.Sprintf("%x", digest.Sum(make([]byte, 0))) + "\n")
+	if condition.CreateOnly {
+		writer.WriteString("IF-NONE-MATCH *\n")
+	} else if condition.IfMatch != "" {
+		writer.WriteString("IF-MATCH " + condition.IfMatch + "\n")
+	}
+	writer.WriteString("\n")
+	writer.Flush()
+	return true
+
+}
+
+// PutResults collects the server's response to each file of an upload,
+// keyed by file name. Files missing from it got no response.
+type PutResults struct {
+	mutex    sync.Mutex
+	Outcomes map[string]string
+}
+
+func NewPutResults() *PutResults {
+	return &PutResults{Outcomes: make(map[string]string)}
+}
+
+// Record notes the response for filename. It is a no-op on a nil collector.
+func (results *PutResults) Record(filename string, response string) {
+	if results == nil || response == "" {
+		return
+	}
+	results.mutex.Lock()
+	results.Outcomes[filename] = response
+	results.mutex.Unlock()
+}
 
-	writer.WriteString("PUT " + filename + "\n")
-	writer.WriteString("LENGTH " + strconv.FormatInt(fileInfo.Size(), 10) + "\n\n")
+// LinkFiles offers every file to the server by checksum first and returns
+// those it did not already have, which still need a full PUT. ok is false if
+// the connection failed.
+func LinkFiles(filenames []string, reader *bufio.Reader, writer *bufio.Writer, pipelined bool, condition PutCondition, results *PutResults) (remaining []string, ok bool) {
 
-	buffer := make([]byte, 1024)
-	var sentBytes int64 = 0
-	readBytes, error := file.Read(buffer)
-	for error == nil {
+	remaining = make([]string, 0)
+	offered := make([]string, 0)
 
-		sentBytes += int64(readBytes)
+	for i := 0; i < len(filenames); i++ {
 
-		checksum.Write(buffer[:readBytes])
-		writer.WriteString(string(buffer[:readBytes]))
+		if !PutLinkSend(filenames[i], writer, condition) {
+			continue
+		}
+		offered = append(offered, filenames[i])
+
+		if pipelined {
+			continue
+		}
 
-		readBytes, error = file.Read(buffer)
+		response := ParsePutResponse(reader)
+		if response == "" {
+			return remaining, false
+		} else if response == "NOTFOUND" {
+			remaining = append(remaining, filenames[i])
+		} else {
+			results.Record(filenames[i], response)
+		}
 
 	}
 
-	writer.WriteString("\n\nCHECKSUM " + fmt.Sprintf("%x", checksum.Sum(make([]byte, 0))) + "\n\n")
-	writer.Flush()
-	return true
+	if pipelined {
+		for i := 0; i < len(offered); i++ {
+			response := ParsePutResponse(reader)
+			if response == "" {
+				return remaining, false
+			} else if response == "NOTFOUND" {
+				remaining = append(remaining, offered[i])
+			} else {
+				results.Record(offered[i], response)
+			}
+		}
+	}
+
+	return remaining, true
 
 }
 
-func PutRequest(filenames []string, pipelined bool) {
+func PutRequest(filenames []string, pipelined bool, condition PutCondition, results *PutResults) {
 
 	ConnLimitSem <- 1
 
 	fmt.Println("Putting", filenames, "Pipelined:", pipelined)
-	connx, error := net.DialTCP("tcp", nil, ServerAddr)
+	connx, error := DialServer()
 	if error != nil {
 		fmt.Println("Error connecting to server:", error)
 		NetWorkerWG.Done()
@@ -626,10 +1006,20 @@ func PutRequest(filenames []string, pipelined bool) {
 	writer := bufio.NewWriter(connx)
 	defer connx.Close()
 
+	if Dedup {
+		var ok bool
+		filenames, ok = LinkFiles(filenames, reader, writer, pipelined, condition, results)
+		if !ok {
+			NetWorkerWG.Done()
+			<-ConnLimitSem
+			return
+		}
+	}
+
 	if pipelined {
 
 		for i := 0; i < len(filenames); i++ {
-			success := PutRequestSend(filenames[i], writer)
+			success := PutRequestSend(filenames[i], writer, condition)
 			if !success {
 				NetWorkerWG.Done()
 				return
@@ -637,50 +1027,30 @@ func PutRequest(filenames []string, pipelined bool) {
 		}
 
 		for i := 0; i < len(filenames); i++ {
-
-			line, _, error := reader.ReadLine()
-			if error != nil {
-				fmt.Println("Connection terminated:", error)
+			response := ParsePutResponse(reader)
+			if response == "" {
 				NetWorkerWG.Done()
 				return
 			}
-
-			toParse := string(line)
-			input := strings.Split(toParse, " ")
-
-			if strings.ToUpper(input[0]) == "RECV" {
-				fmt.Println("Sent file", input[1]+".")
-			} else if strings.ToUpper(input[0]) == "WRERR" {
-				fmt.Println("Failed to write file", input[1]+".")
-			}
-
+			results.Record(filenames[i], response)
 		}
 
 	} else {
 
 		for i := 0; i < len(filenames); i++ {
 
-			success := PutRequestSend(filenames[i], writer)
+			success := PutRequestSend(filenames[i], writer, condition)
 			if !success {
 				NetWorkerWG.Done()
 				return
 			}
 
-			line, _, error := reader.ReadLine()
-			if error != nil {
-				fmt.Println("Connection terminated:", error)
+			response := ParsePutResponse(reader)
+			if response == "" {
 				NetWorkerWG.Done()
 				return
 			}
-
-			toParse := string(line)
-			input := strings.Split(toParse, " ")
-
-			if strings.ToUpper(input[0]) == "RECV" {
-				fmt.Println("Sent file", input[1]+".")
-			} else if strings.ToUpper(input[0]) == "WRERR" {
-				fmt.Println("Failed to write file", input[1]+".")
-			}
+			results.Record(filenames[i], response)
 
 		}
 
@@ -694,8 +1064,16 @@ func PutRequest(filenames []string, pipelined bool) {
 
 }
 
-func PutFiles(filenames []string) {
+func PutFiles(filenames []string, condition PutCondition) {
+	SendFiles(filenames, condition)
+	UIMutex.Unlock()
+}
+
+// SendFiles uploads filenames using the current transfer mode and returns
+// the server's response to each.
+func SendFiles(filenames []string, condition PutCondition) *PutResults {
 
+	results := NewPutResults()
 	timeStart := time.Now()
 	ConnLimitSem = make(chan int, MaxParallel)
 
@@ -712,16 +1090,17 @@ func PutFiles(filenames []string) {
 			NetWorkerWG.Add(1)
 			temp := make([]string, 1)
 			temp[0] = filenames[i]
-			go PutRequest(temp, false)
+			go PutRequest(temp, false, condition, results)
 
 		}
 
 		NetWorkerWG.Wait()
 
-	case kTXModePersistent, kTXModePipelined:
+	case kTXModePersistent, kTXModePipelined, kTXModeMultiplexed:
 
+		// Uploads are not multiplexed; they are pipelined instead.
 		NetWorkerWG.Add(1)
-		go PutRequest(filenames, TxMode == kTXModePipelined)
+		go PutRequest(filenames, TxMode != kTXModePersistent, condition, results)
 		NetWorkerWG.Wait()
 
 	}
@@ -729,13 +1108,19 @@ func PutFiles(filenames []string) {
 	dur := time.Since(timeStart)
 	fmt.Println("Took", dur, "to put files.")
 
-	UIMutex.Unlock()
+	return results
 
 }
 
 func updateServerEP() {
 
-	listenPort := Host + ":" + Port
+	if strings.HasPrefix(Host, "unix:") {
+		ServerAddr = &net.UnixAddr{Name: strings.TrimPrefix(Host, "unix:"), Net: "unix"}
+		ValidEP = true
+		return
+	}
+
+	listenPort := net.JoinHostPort(Host, Port)
 	tcpAddress, error := net.ResolveTCPAddr("tcp", listenPort)
 	if error != nil {
 		fmt.Println("Address resolution error:", error)
@@ -748,6 +1133,30 @@ func updateServerEP() {
 
 }
 
+// ErrNoServer is returned when the server's address could not be resolved.
+var ErrNoServer = errors.New("no valid server address")
+
+// DialServer connects to the server over TCP, or its Unix socket if the
+// host was given as unix:<path>, with TLS if enabled.
+func DialServer() (net.Conn, error) {
+
+	if !ValidEP || ServerAddr == nil {
+		return nil, ErrNoServer
+	}
+
+	if !UseTLS {
+		return net.Dial(ServerAddr.Network(), ServerAddr.String())
+	}
+
+	config := TLSConfig.Clone()
+	config.ServerName = Host
+	if ServerAddr.Network() == "unix" {
+		config.ServerName = "localhost"
+	}
+	return tls.Dial(ServerAddr.Network(), ServerAddr.String(), config)
+
+}
+
 func main() {
 
 	InitFlags()
@@ -778,11 +1187,30 @@ func main() {
 		TxMode = kTXModePipelined
 		runTest = true
 
+	case "multiplexed":
+		fmt.Println("Mode: multiplexed")
+		TxMode = kTXModeMultiplexed
+		runTest = true
+
 	default:
 		TxMode = kTXModeSingle
 		runTest = false
 	}
 
+	if UploadDir != "" {
+		UploadDaemon(UploadDir)
+		return
+	}
+
+	if flag.NArg() > 0 && flag.Arg(0) == "mount" {
+		if flag.NArg() != 2 {
+			fmt.Println("Usage: client [flags] mount <mountpoint>")
+			return
+		}
+		MountForeground(flag.Arg(1))
+		return
+	}
+
 	if runTest {
 
 		UIMutex.Lock()
@@ -824,7 +1252,7 @@ func main() {
 
 			if len(input) == 2 && input[1] != "" {
 				Host = input[1]
-				fmt.Println("Server:", Host+":"+Port)
+				fmt.Println("Server:", net.JoinHostPort(Host, Port))
 				updateServerEP()
 			} else {
 				fmt.Println("Server Host:", Host)
@@ -836,7 +1264,7 @@ func main() {
 
 			if len(input) == 2 && input[1] != "" {
 				Port = input[1]
-				fmt.Println("Server:", Host+":"+Port)
+				fmt.Println("Server:", net.JoinHostPort(Host, Port))
 				updateServerEP()
 			} else {
 				fmt.Println("Server Port:", Port)
@@ -860,6 +1288,43 @@ func main() {
 
 			UIMutex.Unlock()
 
+		case "ratelimit":
+
+			if len(input) == 2 && input[1] != "" {
+				rate, error := common.ParseRate(input[1])
+				if error != nil {
+					fmt.Println("Error parsing rate limit:", error)
+					UIMutex.Unlock()
+					continue
+				}
+				// Transfers in progress hold on to the bucket, so it is
+				// changed in place rather than replaced.
+				RateLimit = rate
+				RateBucket.SetRate(RateLimit)
+			}
+			if RateLimit > 0 {
+				fmt.Println("Rate limit:", RateLimit, "bytes/s")
+			} else {
+				fmt.Println("Rate limit: unlimited")
+			}
+
+			UIMutex.Unlock()
+
+		case "dedup":
+
+			if len(input) == 2 && strings.ToLower(input[1]) == "on" {
+				Dedup = true
+			} else if len(input) == 2 && strings.ToLower(input[1]) == "off" {
+				Dedup = false
+			}
+			if Dedup {
+				fmt.Println("Deduplicated uploads: on")
+			} else {
+				fmt.Println("Deduplicated uploads: off")
+			}
+
+			UIMutex.Unlock()
+
 		case "mode":
 
 			if len(input) == 1 {
@@ -888,6 +1353,10 @@ func main() {
 					fmt.Println("Mode:", TXModeStrings[TxMode], "=> pipelined")
 					TxMode = kTXModePipelined
 
+				case "multiplexed":
+					fmt.Println("Mode:", TXModeStrings[TxMode], "=> multiplexed")
+					TxMode = kTXModeMultiplexed
+
 				case "list":
 					fallthrough
 				default:
@@ -899,7 +1368,7 @@ func main() {
 				}
 
 			} else {
-				fmt.Println("Invalid syntax. Usage: mode <single/parallel/persistent/pipelined>")
+				fmt.Println("Invalid syntax. Usage: mode <single/parallel/persistent/pipelined/multiplexed>")
 			}
 
 			UIMutex.Unlock()
@@ -985,6 +1454,167 @@ func main() {
 
 			UIMutex.Unlock()
 
+		case "versions":
+
+			if len(input) != 2 || input[1] == "" {
+				fmt.Println("Invalid syntax. Usage: versions <file name>")
+				UIMutex.Unlock()
+				continue
+			}
+
+			versionList := GetListing("VERSIONS "+input[1]+"\n\n", input[1], "versions of "+input[1])
+			for i := 0; i < len(versionList); i++ {
+				if versionList[i] != "" {
+					fmt.Println(versionList[i])
+				}
+			}
+
+			UIMutex.Unlock()
+
+		case "rm":
+
+			if !ValidEP {
+				fmt.Println("Please set a valid server host and port with the \"host\" and \"port\" commands.")
+				UIMutex.Unlock()
+				continue
+			}
+
+			if len(input) < 2 {
+				fmt.Println("Invalid syntax. Usage: rm <file1> [file2] …")
+				UIMutex.Unlock()
+				continue
+			}
+
+			for i := 1; i < len(input); i++ {
+				if input[i] == "" {
+					continue
+				}
+				response := SimpleRequest("DELETE " + input[i])
+				if len(response) == 0 {
+					break
+				}
+				switch strings.ToUpper(response[0]) {
+				case "DELETED":
+					fmt.Println("Deleted", input[i]+".")
+				case "NOTFOUND":
+					fmt.Println("File", input[i], "was not found on the server.")
+				default:
+					fmt.Println("Failed to delete", input[i]+".")
+				}
+			}
+
+			UIMutex.Unlock()
+
+		case "trash":
+
+			trashList := GetListing("TRASH\n\n", "", "trash listing")
+			for i := 0; i < len(trashList); i++ {
+				if trashList[i] != "" {
+					fmt.Println(trashList[i])
+				}
+			}
+
+			UIMutex.Unlock()
+
+		case "undelete":
+
+			if len(input) < 2 || len(input) > 3 || input[1] == "" {
+				fmt.Println("Invalid syntax. Usage: undelete <file name> [trash id]")
+				UIMutex.Unlock()
+				continue
+			}
+
+			response := SimpleRequest("UNDELETE " + strings.Join(input[1:], " "))
+			if len(response) > 0 {
+				switch strings.ToUpper(response[0]) {
+				case "RESTORED":
+					fmt.Println("Restored", input[1]+".")
+				case "NOTFOUND":
+					fmt.Println("No deleted copy of", input[1], "was found on the server.")
+				default:
+					fmt.Println("Failed to restore", input[1]+".")
+				}
+			}
+
+			UIMutex.Unlock()
+
+		case "restore":
+
+			if !ValidEP {
+				fmt.Println("Please set a valid server host and port with the \"host\" and \"port\" commands.")
+				UIMutex.Unlock()
+				continue
+			}
+
+			if len(input) != 3 || input[1] == "" || input[2] == "" {
+				fmt.Println("Invalid syntax. Usage: restore <file name> <version id>")
+				UIMutex.Unlock()
+				continue
+			}
+
+			go RestoreVersion(input[1], input[2])
+
+		case "watch":
+
+			if !ValidEP {
+				fmt.Println("Please set a valid server host and port with the \"host\" and \"port\" commands.")
+				UIMutex.Unlock()
+				continue
+			}
+
+			watchPath := ""
+			download := false
+			for i := 1; i < len(input); i++ {
+				if input[i] == "--get" {
+					download = true
+				} else if input[i] != "" {
+					watchPath = input[i]
+				}
+			}
+
+			go WatchServer(watchPath, download)
+
+			UIMutex.Unlock()
+
+		case "unwatch":
+
+			if !StopWatch() {
+				fmt.Println("Not watching the server.")
+			}
+
+			UIMutex.Unlock()
+
+		case "mount":
+
+			if !ValidEP {
+				fmt.Println("Please set a valid server host and port with the \"host\" and \"port\" commands.")
+				UIMutex.Unlock()
+				continue
+			}
+
+			if len(input) != 2 || input[1] == "" {
+				fmt.Println("Invalid syntax. Usage: mount <directory>")
+				UIMutex.Unlock()
+				continue
+			}
+
+			go func(mountpoint string) {
+				error := Mount(mountpoint)
+				if error != nil {
+					fmt.Println("Error mounting", mountpoint+":", error)
+				}
+			}(input[1])
+
+			UIMutex.Unlock()
+
+		case "umount":
+
+			if !Unmount() {
+				fmt.Println("Nothing is mounted.")
+			}
+
+			UIMutex.Unlock()
+
 		case "getall":
 
 			if !ValidEP {
@@ -995,6 +1625,16 @@ func main() {
 
 			go GetAll()
 
+		case "sync":
+
+			if !ValidEP {
+				fmt.Println("Please set a valid server host and port with the \"host\" and \"port\" commands.")
+				UIMutex.Unlock()
+				continue
+			}
+
+			go SyncAll()
+
 		case "put":
 
 			if !ValidEP {
@@ -1004,39 +1644,54 @@ func main() {
 			}
 
 			destFiles := make([]string, 0)
+			var condition PutCondition
 
 			epicfail := true
 			for i := 1; i < len(input); i++ {
-				if input[i] != "" {
+				if input[i] == "--create" {
+					condition.CreateOnly = true
+				} else if input[i] == "--if-match" && i+1 < len(input) {
+					condition.IfMatch = strings.ToLower(input[i+1])
+					i++
+				} else if input[i] != "" {
 					epicfail = false
 					destFiles = append(destFiles, input[i])
 				}
 			}
 
-			if epicfail {
-				fmt.Println("Invalid syntax. Usage: put <file name>")
+			if epicfail || (condition.CreateOnly && condition.IfMatch != "") {
+				fmt.Println("Invalid syntax. Usage: put [--create | --if-match <md5>] <file name>")
 				UIMutex.Unlock()
 				continue
 			}
 
-			go PutFiles(destFiles)
+			go PutFiles(destFiles, condition)
 
 		case "help":
 			if len(input) < 2 {
-				fmt.Println("Commands: host, port, climit, mode, get, getall, put, ls, rls, help, exit\n")
+				fmt.Println("Commands: host, port, climit, ratelimit, dedup, mode, get, getall, sync, put, rm, trash, undelete, versions, restore, watch, unwatch, mount, umount, ls, rls, help, exit\n")
 				fmt.Println("For more info type: help <command name>")
 			} else {
 
 				switch input[1] {
 				case "host":
-					fmt.Println("Sets the server's hostname.\n")
+					fmt.Println("Sets the server's hostname. A host of unix:<path> connects to a server's local socket instead, and the port is ignored.\n")
 					fmt.Println("Usage: host <hostname/ip>")
+					fmt.Println("       host unix:<path>")
 				case "port":
 					fmt.Println("Sets the server's port. Port may be specified as a number or protocol identifier.\n")
 					fmt.Println("Usage: port <port>")
 				case "climit":
 					fmt.Println("Sets the maximum number of TCP connections to use in parallel mode.\n")
 					fmt.Println("Usage: climit <maximum connections>")
+				case "ratelimit":
+					fmt.Println("Sets the maximum transfer rate in bytes per second, shared by all connections. Accepts k, M and G suffixes; 0 removes the limit.")
+					fmt.Println("")
+					fmt.Println("Usage: ratelimit <rate>")
+				case "dedup":
+					fmt.Println("Before uploading a file, asks the server whether it already holds identical contents and, if so, stores the file without sending it.")
+					fmt.Println("")
+					fmt.Println("Usage: dedup [on/off]")
 				case "mode":
 					fmt.Println("Switches transfer modes.\n")
 					fmt.Println("Usage: mode        || Prints current mode.")
@@ -1048,9 +1703,51 @@ func main() {
 				case "getall":
 					fmt.Println("Downloads the file index from the server and all listed files.\n")
 					fmt.Println("Usage: getall")
+				case "sync":
+					fmt.Println("Compares the server's manifest with the current directory and downloads only missing and changed files, into subdirectories as needed.")
+					fmt.Println("")
+					fmt.Println("Usage: sync")
 				case "put":
 					fmt.Println("Uploads the specified file(s) to the server.\n")
 					fmt.Println("Usage: put <file1> [file2] [file3] …")
+					fmt.Println("       put --create <file1> …          || Only creates files; existing ones are left alone.")
+					fmt.Println("       put --if-match <md5> <file1> …  || Only replaces files whose current checksum is <md5>.")
+				case "versions":
+					fmt.Println("Lists the prior versions of a file kept on the server: id, size, checksum and modification time.")
+					fmt.Println("")
+					fmt.Println("Usage: versions <file name>")
+				case "restore":
+					fmt.Println("Downloads a prior version of a file into the current directory and uploads it as the current version.")
+					fmt.Println("")
+					fmt.Println("Usage: restore <file name> <version id>")
+				case "rm":
+					fmt.Println("Deletes the specified file(s) on the server. If the server keeps a trash they can be recovered with \"undelete\".")
+					fmt.Println("")
+					fmt.Println("Usage: rm <file1> [file2] [file3] …")
+				case "trash":
+					fmt.Println("Lists recoverable files in the server's trash: trash id, name, size and deletion time.")
+					fmt.Println("")
+					fmt.Println("Usage: trash")
+				case "undelete":
+					fmt.Println("Recovers a file from the server's trash. Without a trash id the most recently deleted copy is used.")
+					fmt.Println("")
+					fmt.Println("Usage: undelete <file name> [trash id]")
+				case "watch":
+					fmt.Println("Prints changes to files on the server as they happen, in the background. With --get, new and changed files are downloaded too.")
+					fmt.Println("")
+					fmt.Println("Usage: watch [path] [--get]")
+				case "unwatch":
+					fmt.Println("Stops watching the server.")
+					fmt.Println("")
+					fmt.Println("Usage: unwatch")
+				case "mount":
+					fmt.Println("Mounts the server's files as a local directory, in the background. Reads fetch blocks on demand and written files are uploaded when closed.")
+					fmt.Println("")
+					fmt.Println("Usage: mount <directory>")
+				case "umount":
+					fmt.Println("Unmounts the server's files.")
+					fmt.Println("")
+					fmt.Println("Usage: umount")
 				case "ls":
 					fmt.Println("Lists all files in the current working directory.\n")
 					fmt.Println("Usage: ls")
@@ -1067,7 +1764,7 @@ func main() {
 					fmt.Println("Usage: quit")
 					fmt.Println("       exit")
 				default:
-					fmt.Println("Commands: host, port, climit, mode, get, getall, put, ls, rls, help, exit\n")
+					fmt.Println("Commands: host, port, climit, ratelimit, dedup, mode, get, getall, sync, put, rm, trash, undelete, versions, restore, watch, unwatch, mount, umount, ls, rls, help, exit\n")
 					fmt.Println("For more info type: help <command name>")
 				}
 
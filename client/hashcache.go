@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	// HashCacheFile keeps the checksums of local files between runs, in the
+	// same format as the upload state. They are only kept in memory if it
+	// is empty.
+	HashCacheFile string
+
+	hashMutex   sync.Mutex
+	localHashes map[string]uploadRecord
+	hashesDirty bool
+)
+
+// CachedChecksum returns the hex MD5 of a local file, or "" if it is not a
+// readable regular file. The file is only read if its size or modification
+// time changed since it was last hashed.
+func CachedChecksum(filename string) string {
+
+	fileInfo, error := os.Stat(filename)
+	if error != nil || !fileInfo.Mode().IsRegular() {
+		return ""
+	}
+
+	hashMutex.Lock()
+	loadHashCache()
+	record, found := localHashes[filename]
+	hashMutex.Unlock()
+
+	if found && record.Size == fileInfo.Size() && record.ModTime == fileInfo.ModTime().UnixNano() {
+		return record.Checksum
+	}
+
+	checksum := LocalChecksum(filename)
+	if checksum == "" {
+		return ""
+	}
+
+	storeChecksum(filename, fileInfo, checksum)
+	return checksum
+
+}
+
+// RememberChecksum records the checksum of a file that was just written
+// with known contents, such as a verified download, so it is not read again.
+func RememberChecksum(filename string, checksum string) {
+
+	fileInfo, error := os.Stat(filename)
+	if error != nil {
+		return
+	}
+	storeChecksum(filename, fileInfo, checksum)
+
+}
+
+func storeChecksum(filename string, fileInfo os.FileInfo, checksum string) {
+
+	hashMutex.Lock()
+	loadHashCache()
+	localHashes[filename] = uploadRecord{Checksum: checksum, Size: fileInfo.Size(), ModTime: fileInfo.ModTime().UnixNano()}
+	hashesDirty = true
+	hashMutex.Unlock()
+
+}
+
+// loadHashCache reads HashCacheFile the first time a checksum is needed.
+// Callers hold hashMutex.
+func loadHashCache() {
+
+	if localHashes != nil {
+		return
+	}
+	localHashes = make(map[string]uploadRecord)
+	if HashCacheFile != "" {
+		localHashes = LoadUploadState(HashCacheFile)
+	}
+
+}
+
+// SaveHashCache writes the checksums computed since the last save to
+// HashCacheFile.
+func SaveHashCache() {
+
+	if HashCacheFile == "" {
+		return
+	}
+
+	hashMutex.Lock()
+	defer hashMutex.Unlock()
+
+	if !hashesDirty {
+		return
+	}
+
+	error := SaveUploadState(HashCacheFile, localHashes)
+	if error != nil {
+		fmt.Println("Error saving", HashCacheFile+":", error)
+		return
+	}
+	hashesDirty = false
+
+}
@@ -0,0 +1,1224 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FUSE kernel protocol, version 7.26. Only what a read/write mount of the
+// server needs is implemented; anything else is answered with ENOSYS.
+const (
+	kFuseLookup      = 1
+	kFuseForget      = 2
+	kFuseGetattr     = 3
+	kFuseSetattr     = 4
+	kFuseMkdir       = 9
+	kFuseUnlink      = 10
+	kFuseRmdir       = 11
+	kFuseRename      = 12
+	kFuseOpen        = 14
+	kFuseRead        = 15
+	kFuseWrite       = 16
+	kFuseStatfs      = 17
+	kFuseRelease     = 18
+	kFuseFsync       = 20
+	kFuseFlush       = 25
+	kFuseInit        = 26
+	kFuseOpendir     = 27
+	kFuseReaddir     = 28
+	kFuseReleasedir  = 29
+	kFuseAccess      = 34
+	kFuseCreate      = 35
+	kFuseInterrupt   = 36
+	kFuseDestroy     = 38
+	kFuseBatchForget = 42
+
+	kFuseRootID      = 1
+	kFuseMaxWrite    = 128 * 1024
+	kFuseAsyncRead   = 1 << 0
+	kFuseBigWrites   = 1 << 5
+	kFuseSetattrSize = 1 << 3
+	kFuseSetattrFh   = 1 << 6
+)
+
+type fuseInHeader struct {
+	Len     uint32
+	Opcode  uint32
+	Unique  uint64
+	NodeID  uint64
+	UID     uint32
+	GID     uint32
+	PID     uint32
+	Padding uint32
+}
+
+type fuseOutHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+type fuseAttr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	UID       uint32
+	GID       uint32
+	Rdev      uint32
+	Blksize   uint32
+	Flags     uint32
+}
+
+type fuseEntryOut struct {
+	NodeID         uint64
+	Generation     uint64
+	EntryValid     uint64
+	AttrValid      uint64
+	EntryValidNsec uint32
+	AttrValidNsec  uint32
+	Attr           fuseAttr
+}
+
+type fuseAttrOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Dummy         uint32
+	Attr          fuseAttr
+}
+
+type fuseInitIn struct {
+	Major        uint32
+	Minor        uint32
+	MaxReadahead uint32
+	Flags        uint32
+}
+
+type fuseInitOut struct {
+	Major               uint32
+	Minor               uint32
+	MaxReadahead        uint32
+	Flags               uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	TimeGran            uint32
+	MaxPages            uint16
+	MapAlignment        uint16
+	Flags2              uint32
+	Unused              [7]uint32
+}
+
+type fuseOpenIn struct {
+	Flags     uint32
+	OpenFlags uint32
+}
+
+type fuseOpenOut struct {
+	Fh        uint64
+	OpenFlags uint32
+	Padding   uint32
+}
+
+type fuseMkdirIn struct {
+	Mode  uint32
+	Umask uint32
+}
+
+type fuseCreateIn struct {
+	Flags     uint32
+	Mode      uint32
+	Umask     uint32
+	OpenFlags uint32
+}
+
+// fuseIOIn is the common layout of fuse_read_in and fuse_write_in.
+type fuseIOIn struct {
+	Fh        uint64
+	Offset    uint64
+	Size      uint32
+	IOFlags   uint32
+	LockOwner uint64
+	Flags     uint32
+	Padding   uint32
+}
+
+type fuseWriteOut struct {
+	Size    uint32
+	Padding uint32
+}
+
+type fuseSetattrIn struct {
+	Valid     uint32
+	Padding   uint32
+	Fh        uint64
+	Size      uint64
+	LockOwner uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Unused4   uint32
+	UID       uint32
+	GID       uint32
+	Unused5   uint32
+}
+
+type fuseKstatfs struct {
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Bsize   uint32
+	Namelen uint32
+	Frsize  uint32
+	Padding uint32
+	Spare   [6]uint32
+}
+
+type fuseDirent struct {
+	Ino     uint64
+	Off     uint64
+	Namelen uint32
+	Type    uint32
+}
+
+// fuseHandle is an open file or directory. Files opened for writing are
+// staged in a local temporary file and uploaded when closed. A file created
+// through the handle is kept in the tree until then.
+type fuseHandle struct {
+	name     string
+	checksum string
+	staging  *os.File
+	dirty    bool
+	created  bool
+	entries  []string
+	mutex    sync.Mutex
+}
+
+// RemoteMount presents the server's files directory as a local filesystem.
+type RemoteMount struct {
+	fd         int
+	mountpoint string
+	tree       *RemoteTree
+	blocks     *BlockCache
+	started    time.Time
+	uid        uint32
+	gid        uint32
+
+	mutex      sync.Mutex
+	paths      map[uint64]string
+	nodes      map[string]uint64
+	nextNode   uint64
+	handles    map[uint64]*fuseHandle
+	nextHandle uint64
+}
+
+var (
+	mountMutex  sync.Mutex
+	activeMount *RemoteMount
+)
+
+// Mount attaches the server's files at mountpoint and serves requests until
+// it is unmounted.
+func Mount(mountpoint string) error {
+
+	fd, error := mountFuse(mountpoint)
+	if error != nil {
+		return error
+	}
+
+	mount := &RemoteMount{
+		fd:         fd,
+		mountpoint: mountpoint,
+		tree:       NewRemoteTree(),
+		blocks:     NewBlockCache(),
+		started:    time.Now(),
+		uid:        uint32(os.Getuid()),
+		gid:        uint32(os.Getgid()),
+		paths:      map[uint64]string{kFuseRootID: ""},
+		nodes:      map[string]uint64{"": kFuseRootID},
+		nextNode:   kFuseRootID + 1,
+		handles:    make(map[uint64]*fuseHandle),
+		nextHandle: 1,
+	}
+
+	mountMutex.Lock()
+	activeMount = mount
+	mountMutex.Unlock()
+
+	mount.tree.Refresh(true)
+	fmt.Println("Mounted server at", mountpoint+".")
+
+	mount.serve()
+
+	mountMutex.Lock()
+	if activeMount == mount {
+		activeMount = nil
+	}
+	mountMutex.Unlock()
+
+	syscall.Close(fd)
+	CloseRangeConns()
+	fmt.Println("Unmounted", mountpoint+".")
+	return nil
+
+}
+
+// Unmount detaches the active mount, if any, and reports whether there was
+// one.
+func Unmount() bool {
+
+	mountMutex.Lock()
+	mount := activeMount
+	mountMutex.Unlock()
+
+	if mount == nil {
+		return false
+	}
+
+	error := syscall.Unmount(mount.mountpoint, 0)
+	if error != nil {
+		error = exec.Command(fusermountPath(), "-u", mount.mountpoint).Run()
+	}
+	if error != nil {
+		fmt.Println("Error unmounting", mount.mountpoint+":", error)
+	}
+	return true
+
+}
+
+func fusermountPath() string {
+	if found, error := exec.LookPath("fusermount3"); error == nil {
+		return found
+	}
+	return "fusermount"
+}
+
+// mountFuse opens /dev/fuse and mounts it directly when privileged, or has
+// the setuid fusermount helper do so and pass back the descriptor.
+func mountFuse(mountpoint string) (int, error) {
+
+	fd, error := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if error == nil {
+		options := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d", fd, os.Getuid(), os.Getgid())
+		error = syscall.Mount("tcpft", mountpoint, "fuse.tcpft", syscall.MS_NOSUID|syscall.MS_NODEV, options)
+		if error == nil {
+			return fd, nil
+		}
+		syscall.Close(fd)
+	}
+
+	sockets, error := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if error != nil {
+		return -1, error
+	}
+	defer syscall.Close(sockets[1])
+
+	childSocket := os.NewFile(uintptr(sockets[0]), "fusermount")
+	command := exec.Command(fusermountPath(), "-o", "fsname=tcpft,subtype=tcpft", "--", mountpoint)
+	command.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	command.ExtraFiles = []*os.File{childSocket}
+	command.Stderr = os.Stderr
+	error = command.Run()
+	childSocket.Close()
+	if error != nil {
+		return -1, fmt.Errorf("fusermount: %v", error)
+	}
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, error := syscall.Recvmsg(sockets[1], make([]byte, 1), oob, 0)
+	if error != nil {
+		return -1, error
+	}
+
+	messages, error := syscall.ParseSocketControlMessage(oob[:oobn])
+	if error != nil || len(messages) == 0 {
+		return -1, fmt.Errorf("fusermount did not pass a descriptor")
+	}
+	fds, error := syscall.ParseUnixRights(&messages[0])
+	if error != nil || len(fds) == 0 {
+		return -1, fmt.Errorf("fusermount did not pass a descriptor")
+	}
+
+	return fds[0], nil
+
+}
+
+// serve reads requests from the kernel until the filesystem is unmounted.
+// Each is answered on its own goroutine, so a slow download does not hold
+// up the rest.
+func (mount *RemoteMount) serve() {
+
+	for {
+
+		buffer := make([]byte, kFuseMaxWrite+8192)
+		n, error := syscall.Read(mount.fd, buffer)
+		if error == syscall.EINTR || error == syscall.ENOENT || error == syscall.EAGAIN {
+			continue
+		} else if error != nil {
+			return
+		}
+
+		var header fuseInHeader
+		if n < binary.Size(header) {
+			continue
+		}
+		binary.Read(bytes.NewReader(buffer), binary.NativeEndian, &header)
+		body := buffer[binary.Size(header):n]
+
+		switch header.Opcode {
+		case kFuseInit:
+			mount.init(header, body)
+		case kFuseDestroy:
+			return
+		case kFuseForget, kFuseBatchForget, kFuseInterrupt:
+			// No reply is expected; node numbers are never reused.
+		default:
+			go mount.dispatch(header, body)
+		}
+
+	}
+
+}
+
+func (mount *RemoteMount) dispatch(header fuseInHeader, body []byte) {
+
+	switch header.Opcode {
+	case kFuseLookup:
+		mount.lookup(header, cString(body))
+	case kFuseGetattr:
+		mount.getattr(header)
+	case kFuseSetattr:
+		mount.setattr(header, body)
+	case kFuseOpen:
+		mount.open(header, body)
+	case kFuseCreate:
+		mount.create(header, body)
+	case kFuseRead:
+		mount.read(header, body)
+	case kFuseWrite:
+		mount.write(header, body)
+	case kFuseFlush, kFuseFsync:
+		var handleID uint64
+		binary.Read(bytes.NewReader(body), binary.NativeEndian, &handleID)
+		mount.reply(header, mount.upload(mount.handle(handleID)), nil)
+	case kFuseRelease, kFuseReleasedir:
+		mount.release(header, body)
+	case kFuseOpendir:
+		mount.opendir(header)
+	case kFuseReaddir:
+		mount.readdir(header, body)
+	case kFuseUnlink:
+		mount.unlink(header, cString(body))
+	case kFuseMkdir:
+		mount.mkdir(header, body)
+	case kFuseRmdir:
+		mount.rmdir(header, cString(body))
+	case kFuseRename:
+		mount.rename(header, body)
+	case kFuseStatfs:
+		mount.reply(header, 0, fuseKstatfs{Bsize: 4096, Frsize: 4096, Namelen: 255})
+	case kFuseAccess:
+		mount.reply(header, 0, nil)
+	default:
+		mount.reply(header, syscall.ENOSYS, nil)
+	}
+
+}
+
+// reply sends out, which may be nil, a struct or raw bytes, in answer to
+// header, or just errno if it is not zero.
+func (mount *RemoteMount) reply(header fuseInHeader, errno syscall.Errno, out interface{}) {
+
+	var payload bytes.Buffer
+	if errno == 0 && out != nil {
+		if data, raw := out.([]byte); raw {
+			payload.Write(data)
+		} else {
+			binary.Write(&payload, binary.NativeEndian, out)
+		}
+	}
+
+	outHeader := fuseOutHeader{Error: -int32(errno), Unique: header.Unique}
+	outHeader.Len = uint32(binary.Size(outHeader) + payload.Len())
+
+	var message bytes.Buffer
+	binary.Write(&message, binary.NativeEndian, outHeader)
+	message.Write(payload.Bytes())
+
+	syscall.Write(mount.fd, message.Bytes())
+
+}
+
+func (mount *RemoteMount) init(header fuseInHeader, body []byte) {
+
+	var in fuseInitIn
+	binary.Read(bytes.NewReader(body), binary.NativeEndian, &in)
+
+	mount.reply(header, 0, fuseInitOut{
+		Major:               7,
+		Minor:               26,
+		MaxReadahead:        in.MaxReadahead,
+		Flags:               in.Flags & (kFuseAsyncRead | kFuseBigWrites),
+		MaxBackground:       16,
+		CongestionThreshold: 12,
+		MaxWrite:            kFuseMaxWrite,
+		TimeGran:            1,
+	})
+
+}
+
+func cString(data []byte) string {
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		return string(data[:end])
+	}
+	return string(data)
+}
+
+func (mount *RemoteMount) path(node uint64) (string, bool) {
+	mount.mutex.Lock()
+	defer mount.mutex.Unlock()
+	name, found := mount.paths[node]
+	return name, found
+}
+
+func (mount *RemoteMount) node(name string) uint64 {
+
+	mount.mutex.Lock()
+	defer mount.mutex.Unlock()
+
+	if node, found := mount.nodes[name]; found {
+		return node
+	}
+
+	node := mount.nextNode
+	mount.nextNode++
+	mount.nodes[name] = node
+	mount.paths[node] = name
+	return node
+
+}
+
+func (mount *RemoteMount) handle(id uint64) *fuseHandle {
+	mount.mutex.Lock()
+	defer mount.mutex.Unlock()
+	return mount.handles[id]
+}
+
+func (mount *RemoteMount) addHandle(handle *fuseHandle) uint64 {
+	mount.mutex.Lock()
+	defer mount.mutex.Unlock()
+	id := mount.nextHandle
+	mount.nextHandle++
+	mount.handles[id] = handle
+	return id
+}
+
+// stagedSize returns the size of name as written locally but not yet
+// uploaded, if it is open for writing.
+func (mount *RemoteMount) stagedSize(name string) (int64, bool) {
+
+	mount.mutex.Lock()
+	defer mount.mutex.Unlock()
+
+	for _, handle := range mount.handles {
+		if handle.name == name && handle.staging != nil {
+			if fileInfo, error := handle.staging.Stat(); error == nil {
+				return fileInfo.Size(), true
+			}
+		}
+	}
+
+	return 0, false
+
+}
+
+func (mount *RemoteMount) attributes(node uint64, name string, entry RemoteEntry) fuseAttr {
+
+	attr := fuseAttr{
+		Ino:     node,
+		Atime:   uint64(mount.started.Unix()),
+		Mtime:   uint64(mount.started.Unix()),
+		Ctime:   uint64(mount.started.Unix()),
+		UID:     mount.uid,
+		GID:     mount.gid,
+		Blksize: kBlockSize,
+	}
+
+	if entry.Dir {
+		attr.Mode = syscall.S_IFDIR | 0755
+		attr.Nlink = 2
+		return attr
+	}
+
+	size := entry.Size
+	if staged, open := mount.stagedSize(name); open {
+		size = staged
+	}
+
+	attr.Mode = syscall.S_IFREG | 0644
+	attr.Nlink = 1
+	attr.Size = uint64(size)
+	attr.Blocks = uint64((size + 511) / 512)
+	return attr
+
+}
+
+func (mount *RemoteMount) entryOut(name string, entry RemoteEntry) fuseEntryOut {
+	node := mount.node(name)
+	return fuseEntryOut{
+		NodeID:     node,
+		EntryValid: 1,
+		AttrValid:  1,
+		Attr:       mount.attributes(node, name, entry),
+	}
+}
+
+func childName(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "/" + name
+}
+
+func (mount *RemoteMount) lookup(header fuseInHeader, name string) {
+
+	parent, found := mount.path(header.NodeID)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	mount.tree.Refresh(false)
+
+	child := childName(parent, name)
+	entry, found := mount.tree.Lookup(child)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	mount.reply(header, 0, mount.entryOut(child, entry))
+
+}
+
+func (mount *RemoteMount) getattr(header fuseInHeader) {
+
+	name, found := mount.path(header.NodeID)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	mount.tree.Refresh(false)
+
+	entry, found := mount.tree.Lookup(name)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	mount.reply(header, 0, fuseAttrOut{AttrValid: 1, Attr: mount.attributes(header.NodeID, name, entry)})
+
+}
+
+// setattr supports truncation, of the handle given if there is one and it
+// is open for writing, otherwise of the remote file directly. Other changes
+// are accepted and ignored, as the server keeps no modes or times.
+func (mount *RemoteMount) setattr(header fuseInHeader, body []byte) {
+
+	var in fuseSetattrIn
+	binary.Read(bytes.NewReader(body), binary.NativeEndian, &in)
+
+	name, found := mount.path(header.NodeID)
+	entry, known := mount.tree.Lookup(name)
+	if !found || !known {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	if in.Valid&kFuseSetattrSize != 0 && !entry.Dir {
+
+		var handle *fuseHandle
+		if in.Valid&kFuseSetattrFh != 0 {
+			handle = mount.handle(in.Fh)
+		}
+
+		errno := syscall.Errno(0)
+		if handle != nil && handle.staging != nil {
+			handle.mutex.Lock()
+			if handle.staging.Truncate(int64(in.Size)) != nil {
+				errno = syscall.EIO
+			}
+			handle.dirty = true
+			handle.mutex.Unlock()
+		} else {
+			errno = mount.truncate(name, entry, int64(in.Size))
+			entry, _ = mount.tree.Lookup(name)
+		}
+
+		if errno != 0 {
+			mount.reply(header, errno, nil)
+			return
+		}
+
+	}
+
+	mount.reply(header, 0, fuseAttrOut{AttrValid: 1, Attr: mount.attributes(header.NodeID, name, entry)})
+
+}
+
+// stage prepares a handle for writing to name, starting from the current
+// remote contents unless truncate is set.
+func (mount *RemoteMount) stage(name string, entry RemoteEntry, truncate bool) (*fuseHandle, syscall.Errno) {
+
+	staging, error := ioutil.TempFile("", "tcpft-mount-")
+	if error != nil {
+		return nil, syscall.EIO
+	}
+	os.Remove(staging.Name())
+
+	if !truncate && entry.Size > 0 {
+		error = DownloadTo(staging, name, entry.Checksum, entry.Size)
+		if error != nil {
+			staging.Close()
+			return nil, syscall.EIO
+		}
+	}
+
+	return &fuseHandle{name: name, staging: staging, dirty: truncate}, 0
+
+}
+
+func (mount *RemoteMount) open(header fuseInHeader, body []byte) {
+
+	var in fuseOpenIn
+	binary.Read(bytes.NewReader(body), binary.NativeEndian, &in)
+
+	name, found := mount.path(header.NodeID)
+	entry, known := mount.tree.Lookup(name)
+	if !found || !known {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	handle := &fuseHandle{name: name, checksum: entry.Checksum}
+
+	if in.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		var errno syscall.Errno
+		handle, errno = mount.stage(name, entry, in.Flags&syscall.O_TRUNC != 0)
+		if errno != 0 {
+			mount.reply(header, errno, nil)
+			return
+		}
+	}
+
+	mount.reply(header, 0, fuseOpenOut{Fh: mount.addHandle(handle)})
+
+}
+
+func (mount *RemoteMount) create(header fuseInHeader, body []byte) {
+
+	var in fuseCreateIn
+	size := binary.Size(in)
+	if len(body) < size {
+		mount.reply(header, syscall.EINVAL, nil)
+		return
+	}
+	binary.Read(bytes.NewReader(body), binary.NativeEndian, &in)
+
+	parent, found := mount.path(header.NodeID)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	name := childName(parent, cString(body[size:]))
+	entry := RemoteEntry{}
+
+	handle, errno := mount.stage(name, entry, true)
+	if errno != 0 {
+		mount.reply(header, errno, nil)
+		return
+	}
+
+	handle.created = true
+	mount.tree.Keep(name, entry)
+	handleID := mount.addHandle(handle)
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.NativeEndian, mount.entryOut(name, entry))
+	binary.Write(&out, binary.NativeEndian, fuseOpenOut{Fh: handleID})
+	mount.reply(header, 0, out.Bytes())
+
+}
+
+func (mount *RemoteMount) read(header fuseInHeader, body []byte) {
+
+	var in fuseIOIn
+	binary.Read(bytes.NewReader(body), binary.NativeEndian, &in)
+
+	handle := mount.handle(in.Fh)
+	if handle == nil {
+		mount.reply(header, syscall.EBADF, nil)
+		return
+	}
+
+	if handle.staging != nil {
+		data := make([]byte, in.Size)
+		n, _ := handle.staging.ReadAt(data, int64(in.Offset))
+		mount.reply(header, 0, data[:n])
+		return
+	}
+
+	data, error := mount.blocks.ReadAt(handle.name, handle.checksum, int64(in.Offset), int(in.Size))
+	if error == ErrRemoteNotFound {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	} else if error == ErrRemoteChanged {
+		mount.reply(header, syscall.ESTALE, nil)
+		return
+	} else if error != nil {
+		mount.reply(header, syscall.EIO, nil)
+		return
+	}
+
+	mount.reply(header, 0, data)
+
+}
+
+func (mount *RemoteMount) write(header fuseInHeader, body []byte) {
+
+	var in fuseIOIn
+	size := binary.Size(in)
+	binary.Read(bytes.NewReader(body), binary.NativeEndian, &in)
+
+	handle := mount.handle(in.Fh)
+	if handle == nil || handle.staging == nil {
+		mount.reply(header, syscall.EBADF, nil)
+		return
+	}
+
+	end := size + int(in.Size)
+	if end > len(body) {
+		end = len(body)
+	}
+
+	handle.mutex.Lock()
+	n, error := handle.staging.WriteAt(body[size:end], int64(in.Offset))
+	handle.dirty = true
+	handle.mutex.Unlock()
+
+	if error != nil {
+		mount.reply(header, syscall.EIO, nil)
+		return
+	}
+
+	mount.reply(header, 0, fuseWriteOut{Size: uint32(n)})
+
+}
+
+// upload sends a handle's staged contents to the server if they changed
+// since they were last sent.
+func (mount *RemoteMount) upload(handle *fuseHandle) syscall.Errno {
+
+	if handle == nil || handle.staging == nil {
+		return 0
+	}
+
+	handle.mutex.Lock()
+	defer handle.mutex.Unlock()
+
+	if !handle.dirty {
+		return 0
+	}
+
+	if PutFileAs("/proc/self/fd/"+strconv.Itoa(int(handle.staging.Fd())), handle.name) != "RECV" {
+		return syscall.EIO
+	}
+	handle.dirty = false
+
+	checksum := LocalChecksum("/proc/self/fd/" + strconv.Itoa(int(handle.staging.Fd())))
+	if fileInfo, error := handle.staging.Stat(); error == nil {
+		mount.tree.Set(handle.name, RemoteEntry{Size: fileInfo.Size(), Checksum: checksum})
+	}
+
+	return 0
+
+}
+
+func (mount *RemoteMount) release(header fuseInHeader, body []byte) {
+
+	var handleID uint64
+	binary.Read(bytes.NewReader(body), binary.NativeEndian, &handleID)
+
+	handle := mount.handle(handleID)
+	mount.upload(handle)
+
+	mount.mutex.Lock()
+	delete(mount.handles, handleID)
+	mount.mutex.Unlock()
+
+	if handle != nil && handle.staging != nil {
+		handle.staging.Close()
+	}
+	if handle != nil && handle.created {
+		mount.tree.Forget(handle.name)
+	}
+
+	mount.reply(header, 0, nil)
+
+}
+
+func (mount *RemoteMount) opendir(header fuseInHeader) {
+
+	name, found := mount.path(header.NodeID)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	mount.tree.Refresh(false)
+	entries := append([]string{".", ".."}, mount.tree.Children(name)...)
+
+	mount.reply(header, 0, fuseOpenOut{Fh: mount.addHandle(&fuseHandle{name: name, entries: entries})})
+
+}
+
+// readdir packs as many of the entries listed at opendir as fit, starting
+// at the requested offset.
+func (mount *RemoteMount) readdir(header fuseInHeader, body []byte) {
+
+	var in fuseIOIn
+	binary.Read(bytes.NewReader(body), binary.NativeEndian, &in)
+
+	handle := mount.handle(in.Fh)
+	if handle == nil {
+		mount.reply(header, syscall.EBADF, nil)
+		return
+	}
+
+	var out bytes.Buffer
+
+	for i := int(in.Offset); i < len(handle.entries); i++ {
+
+		entryName := handle.entries[i]
+		direntType := uint32(syscall.DT_REG)
+		node := uint64(kFuseRootID)
+
+		if entryName != "." && entryName != ".." {
+			child := childName(handle.name, entryName)
+			entry, _ := mount.tree.Lookup(child)
+			if entry.Dir {
+				direntType = syscall.DT_DIR
+			}
+			node = mount.node(child)
+		} else {
+			direntType = syscall.DT_DIR
+		}
+
+		recordLength := (binary.Size(fuseDirent{}) + len(entryName) + 7) &^ 7
+		if out.Len()+recordLength > int(in.Size) {
+			break
+		}
+
+		binary.Write(&out, binary.NativeEndian, fuseDirent{Ino: node, Off: uint64(i + 1), Namelen: uint32(len(entryName)), Type: direntType})
+		out.WriteString(entryName)
+		out.Write(make([]byte, recordLength-binary.Size(fuseDirent{})-len(entryName)))
+
+	}
+
+	mount.reply(header, 0, out.Bytes())
+
+}
+
+func (mount *RemoteMount) unlink(header fuseInHeader, name string) {
+
+	parent, found := mount.path(header.NodeID)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	child := childName(parent, name)
+	_, known := mount.tree.Lookup(child)
+	response := SimpleRequest("DELETE " + child)
+
+	// A file created here but not yet uploaded is only known locally.
+	if len(response) > 0 && (response[0] == "DELETED" || (response[0] == "NOTFOUND" && known)) {
+		mount.tree.Remove(child)
+		mount.reply(header, 0, nil)
+	} else if len(response) > 0 && response[0] == "NOTFOUND" {
+		mount.tree.Remove(child)
+		mount.reply(header, syscall.ENOENT, nil)
+	} else if len(response) > 0 && response[0] == "REJECTED" {
+		mount.reply(header, syscall.EROFS, nil)
+	} else {
+		mount.reply(header, syscall.EIO, nil)
+	}
+
+}
+
+// truncate sets the size of the remote file name without a handle, by
+// staging it, truncating the staged copy and uploading that.
+func (mount *RemoteMount) truncate(name string, entry RemoteEntry, size int64) syscall.Errno {
+
+	handle, errno := mount.stage(name, entry, size == 0)
+	if errno != 0 {
+		return errno
+	}
+	defer handle.staging.Close()
+
+	if handle.staging.Truncate(size) != nil {
+		return syscall.EIO
+	}
+	handle.dirty = true
+
+	return mount.upload(handle)
+
+}
+
+// mkdir creates a directory on this side only, as the server has no empty
+// directories; it is kept until removed, and exists on the server once a
+// file is written in it.
+func (mount *RemoteMount) mkdir(header fuseInHeader, body []byte) {
+
+	var in fuseMkdirIn
+	size := binary.Size(in)
+	if len(body) < size {
+		mount.reply(header, syscall.EINVAL, nil)
+		return
+	}
+
+	parent, found := mount.path(header.NodeID)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	mount.tree.Refresh(false)
+
+	name := childName(parent, cString(body[size:]))
+	if _, exists := mount.tree.Lookup(name); exists {
+		mount.reply(header, syscall.EEXIST, nil)
+		return
+	}
+
+	entry := RemoteEntry{Dir: true}
+	mount.tree.Keep(name, entry)
+	mount.reply(header, 0, mount.entryOut(name, entry))
+
+}
+
+// rmdir removes an empty directory. Only one created here can be empty, so
+// there is nothing to tell the server.
+func (mount *RemoteMount) rmdir(header fuseInHeader, name string) {
+
+	parent, found := mount.path(header.NodeID)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	mount.tree.Refresh(false)
+
+	child := childName(parent, name)
+	entry, found := mount.tree.Lookup(child)
+	if !found {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	} else if !entry.Dir {
+		mount.reply(header, syscall.ENOTDIR, nil)
+		return
+	} else if len(mount.tree.Children(child)) > 0 {
+		mount.reply(header, syscall.ENOTEMPTY, nil)
+		return
+	}
+
+	mount.tree.Remove(child)
+	mount.reply(header, 0, nil)
+
+}
+
+// rename moves a file, or every file in a directory, to a new name. The
+// protocol has no rename, so each file is copied to its new name and then
+// deleted; handles open on it carry on under the new name.
+func (mount *RemoteMount) rename(header fuseInHeader, body []byte) {
+
+	var newDir uint64
+	size := binary.Size(newDir)
+	if len(body) < size {
+		mount.reply(header, syscall.EINVAL, nil)
+		return
+	}
+	binary.Read(bytes.NewReader(body), binary.NativeEndian, &newDir)
+
+	names := bytes.SplitN(body[size:], []byte{0}, 3)
+	oldParent, oldFound := mount.path(header.NodeID)
+	newParent, newFound := mount.path(newDir)
+	if len(names) < 2 || !oldFound || !newFound {
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	}
+
+	from := childName(oldParent, string(names[0]))
+	to := childName(newParent, string(names[1]))
+
+	mount.tree.Refresh(false)
+
+	entry, found := mount.tree.Lookup(from)
+	target, exists := mount.tree.Lookup(to)
+	switch {
+	case !found:
+		mount.reply(header, syscall.ENOENT, nil)
+		return
+	case from == to:
+		mount.reply(header, 0, nil)
+		return
+	case entry.Dir && strings.HasPrefix(to, from+"/"):
+		mount.reply(header, syscall.EINVAL, nil)
+		return
+	case exists && target.Dir && !entry.Dir:
+		mount.reply(header, syscall.EISDIR, nil)
+		return
+	case exists && !target.Dir && entry.Dir:
+		mount.reply(header, syscall.ENOTDIR, nil)
+		return
+	case exists && target.Dir && len(mount.tree.Children(to)) > 0:
+		mount.reply(header, syscall.ENOTEMPTY, nil)
+		return
+	}
+
+	if !entry.Dir {
+		errno := mount.moveFile(from, to, entry)
+		if errno == 0 {
+			mount.renameNodes(from, to)
+		}
+		mount.reply(header, errno, nil)
+		return
+	}
+
+	mount.tree.Remove(to)
+	for _, name := range append(mount.tree.Below(from), from) {
+
+		moved := to + strings.TrimPrefix(name, from)
+		child, _ := mount.tree.Lookup(name)
+
+		if child.Dir {
+			mount.tree.Remove(name)
+			mount.tree.Keep(moved, child)
+			continue
+		}
+
+		errno := mount.moveFile(name, moved, child)
+		if errno != 0 {
+			mount.reply(header, errno, nil)
+			return
+		}
+
+	}
+
+	mount.renameNodes(from, to)
+	mount.reply(header, 0, nil)
+
+}
+
+// renameNodes gives the nodes of from and everything below it the names
+// they have after a rename, as the kernel keeps using them.
+func (mount *RemoteMount) renameNodes(from string, to string) {
+
+	mount.mutex.Lock()
+	defer mount.mutex.Unlock()
+
+	for name, node := range mount.nodes {
+		if name == from || strings.HasPrefix(name, from+"/") {
+			moved := to + strings.TrimPrefix(name, from)
+			delete(mount.nodes, name)
+			mount.nodes[moved] = node
+			mount.paths[node] = moved
+		}
+	}
+
+}
+
+// moveFile copies the file from to the name to and deletes the original,
+// uploading anything written to it first.
+func (mount *RemoteMount) moveFile(from string, to string, entry RemoteEntry) syscall.Errno {
+
+	mount.mutex.Lock()
+	open := make([]*fuseHandle, 0)
+	for _, handle := range mount.handles {
+		if handle.name == from && handle.staging != nil {
+			open = append(open, handle)
+		}
+	}
+	mount.mutex.Unlock()
+
+	for i := 0; i < len(open); i++ {
+		if errno := mount.upload(open[i]); errno != 0 {
+			return errno
+		}
+	}
+	entry, _ = mount.tree.Lookup(from)
+
+	if len(open) > 0 {
+		// The staged copy is current, so it is sent as it is.
+		open[0].mutex.Lock()
+		response := PutFileAs("/proc/self/fd/"+strconv.Itoa(int(open[0].staging.Fd())), to)
+		open[0].mutex.Unlock()
+		if response != "RECV" {
+			return syscall.EIO
+		}
+	} else {
+		handle, errno := mount.stage(from, entry, false)
+		if errno != 0 {
+			return errno
+		}
+		response := PutFileAs("/proc/self/fd/"+strconv.Itoa(int(handle.staging.Fd())), to)
+		handle.staging.Close()
+		if response != "RECV" {
+			return syscall.EIO
+		}
+	}
+
+	response := SimpleRequest("DELETE " + from)
+	if len(response) == 0 || (response[0] != "DELETED" && response[0] != "NOTFOUND") {
+		return syscall.EIO
+	}
+
+	mount.mutex.Lock()
+	for _, handle := range mount.handles {
+		if handle.name == from {
+			handle.name = to
+		}
+	}
+	mount.mutex.Unlock()
+
+	mount.tree.Remove(from)
+	mount.tree.Set(to, entry)
+	return 0
+
+}
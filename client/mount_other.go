@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Mount is only implemented for Linux's FUSE.
+func Mount(mountpoint string) error {
+	return errors.New("mounting is not supported on this platform")
+}
+
+func Unmount() bool {
+	return false
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../common"
+)
+
+const (
+	// kMaxFramePayload bounds the frames the server may send.
+	kMaxFramePayload = 1024 * 1024
+
+	// kMuxStreams is how many files are requested at once.
+	kMuxStreams = 32
+
+	// kNegotiateTimeout is how long the server has to accept frames.
+	kNegotiateTimeout = 10 * time.Second
+
+	// kMuxGrant is how much of a stream is received before more of its
+	// window is granted back. It should be well under the server's window
+	// so that the stream never stalls.
+	kMuxGrant = 256 * 1024
+)
+
+// muxDownload is one file being received on a multiplexed connection.
+type muxDownload struct {
+	filename   string
+	localFile  string
+	file       *os.File
+	checksum   hash.Hash
+	received   int64
+	ungranted  int
+	writeError error
+}
+
+// start handles the stream's header frame. It returns false if the header
+// ends the stream.
+func (download *muxDownload) start(payload []byte) bool {
+
+	lines := strings.Split(strings.TrimRight(string(payload), "\n"), "\n")
+	input := strings.Split(lines[0], " ")
+
+	switch strings.ToUpper(input[0]) {
+
+	case "OK":
+
+		download.localFile = download.filename + "-part"
+		download.checksum = md5.New()
+		download.file, download.writeError = os.Create(download.localFile)
+		return true
+
+	case "NOTMODIFIED":
+		fmt.Println("File", download.filename, "is up to date.")
+	case "NOTFOUND":
+		fmt.Println("File", download.filename, "was not found on the server.")
+	case "READERR":
+		fmt.Println("Unable to read file", download.filename+".")
+	case "REQERR":
+		fmt.Println("Request Error.")
+	default:
+		fmt.Println("Connection error, invalid response format.")
+
+	}
+
+	return false
+
+}
+
+func (download *muxDownload) write(data []byte) {
+
+	download.checksum.Write(data)
+	download.received += int64(len(data))
+
+	// The rest of the body is still received if the file cannot be
+	// written, but only to be thrown away.
+	if download.writeError == nil {
+		_, download.writeError = download.file.Write(data)
+	}
+
+}
+
+// finish handles the stream's END frame, which carries the checksum.
+func (download *muxDownload) finish(payload []byte) {
+
+	input := strings.Fields(string(payload))
+	received := fmt.Sprintf("%x", download.checksum.Sum(nil))
+
+	if len(input) < 2 || strings.ToUpper(input[0]) != "CHECKSUM" {
+		fmt.Println("Connection error, invalid response format.")
+		download.abort()
+		return
+	}
+
+	if input[1] != received {
+		fmt.Println("Hash mismatch: server claimed", input[1]+", received", received+".")
+		download.abort()
+		return
+	}
+
+	if download.writeError == nil {
+		download.writeError = download.file.Close()
+	}
+	if download.writeError != nil {
+		fmt.Println("Error writing", download.filename+":", download.writeError)
+		download.abort()
+		return
+	}
+
+	fmt.Println("Wrote", strconv.FormatInt(download.received, 10), "bytes to file", download.filename+".")
+	os.Rename(download.localFile, download.filename)
+	RememberChecksum(download.filename, received)
+
+}
+
+// abort discards whatever was received.
+func (download *muxDownload) abort() {
+	if download.file != nil {
+		download.file.Close()
+		os.Remove(download.localFile)
+	}
+}
+
+// negotiated remembers, by server address, the frames NegotiateFrames
+// settled on: "binary", "text", or "none" if the server refused MUX. Later connections then skip the requests the server will not
+// answer, rather than wait for them again.
+var (
+	negotiated      = make(map[string]string)
+	negotiatedMutex sync.Mutex
+)
+
+// NegotiateFrames switches a new connection to frames, binary ones if
+// Framing asks for them and the server agrees, and returns their codec.
+// Servers that predate FRAMING or MUX do not answer unknown commands, so
+// each wait for a reply is bounded; a server that lets FRAMING time out is
+// still asked for MUX.
+func NegotiateFrames(connx net.Conn, reader *bufio.Reader, writer *bufio.Writer) (common.FrameCodec, error) {
+
+	if !ValidEP || ServerAddr == nil {
+		return nil, ErrNoServer
+	}
+
+	server := ServerAddr.Network() + " " + ServerAddr.String()
+	negotiatedMutex.Lock()
+	known := negotiated[server]
+	negotiatedMutex.Unlock()
+
+	if known == "none" {
+		return nil, errors.New("multiplexing not supported")
+	}
+
+	defer connx.SetReadDeadline(time.Time{})
+	framingTimedOut := false
+
+	if Framing == "binary" && known != "text" {
+
+		connx.SetReadDeadline(time.Now().Add(kNegotiateTimeout))
+		writer.WriteString("FRAMING BINARY\n")
+		writer.Flush()
+
+		line, error := reader.ReadString('\n')
+		if error == nil && strings.HasPrefix(line, "FRAMING BINARY") {
+			rememberFrames(server, "binary")
+			return common.BinaryFrames{MaxPayload: kMaxFramePayload}, nil
+		}
+		if netError, ok := error.(net.Error); error != nil && !(ok && netError.Timeout()) {
+			return nil, error
+		}
+		framingTimedOut = error != nil
+
+	}
+
+	connx.SetReadDeadline(time.Now().Add(kNegotiateTimeout))
+	writer.WriteString("MUX\n")
+	writer.Flush()
+
+	// Only a refusal is remembered; a reply that is merely slow may come in
+	// time on the next connection. A late answer to FRAMING comes before
+	// the one to MUX, and if it switched to binary frames the MUX sent
+	// meanwhile has spoiled the connection.
+	line, error := reader.ReadString('\n')
+	if error == nil && framingTimedOut && (strings.HasPrefix(line, "FRAMING") || strings.HasPrefix(line, "REQERR")) {
+		if strings.HasPrefix(line, "FRAMING BINARY") {
+			return nil, errors.New("late answer to FRAMING")
+		}
+		line, error = reader.ReadString('\n')
+	}
+	if error != nil {
+		return nil, error
+	}
+	if !strings.HasPrefix(line, "MUXING") {
+		rememberFrames(server, "none")
+		return nil, errors.New("multiplexing not supported")
+	}
+
+	rememberFrames(server, "text")
+	return common.TextFrames{MaxPayload: kMaxFramePayload}, nil
+
+}
+
+func rememberFrames(server string, frames string) {
+	negotiatedMutex.Lock()
+	negotiated[server] = frames
+	negotiatedMutex.Unlock()
+}
+
+// MuxGetRequest downloads filenames over a single multiplexed connection,
+// kMuxStreams at a time, so that small files are not held up behind large
+// ones. Only GETs are multiplexed. If the server refuses MUX, or does not
+// answer it within kNegotiateTimeout, the files are fetched with pipelined
+// GETs on a new connection instead; files still open when a multiplexed
+// connection fails are reported and not retried.
+func MuxGetRequest(filenames []string) {
+
+	ConnLimitSem <- 1
+
+	fmt.Println("Getting", filenames, "Multiplexed")
+	connx, error := DialServer()
+	if error != nil {
+		fmt.Println("Error connecting to server:", error)
+		NetWorkerWG.Done()
+		<-ConnLimitSem
+		return
+	}
+	defer connx.Close()
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+
+	codec, error := NegotiateFrames(connx, reader, writer)
+	if error != nil {
+		fmt.Println("Unable to multiplex (" + error.Error() + "), using pipelined requests.")
+		connx.Close()
+		<-ConnLimitSem
+		GetRequest(filenames, true)
+		return
+	}
+
+	downloads := make(map[uint32]*muxDownload)
+	var nextStream uint32 = 1
+	next := 0
+
+	for next < len(filenames) || len(downloads) > 0 {
+
+		for next < len(filenames) && len(downloads) < kMuxStreams {
+			request := strings.TrimSuffix(GetRequestLine(filenames[next]), "\n")
+			codec.WriteFrame(writer, common.Frame{Type: common.FrameRequest, Stream: nextStream, Payload: []byte(request)})
+			downloads[nextStream] = &muxDownload{filename: filenames[next]}
+			nextStream++
+			next++
+		}
+
+		// Frames already received are handled before anything is sent,
+		// so that window updates go out together.
+		if reader.Buffered() == 0 {
+			error = writer.Flush()
+			if error != nil {
+				fmt.Println("Connection terminated:", error)
+				break
+			}
+		}
+
+		frame, error := codec.ReadFrame(reader)
+		if error != nil {
+			fmt.Println("Connection terminated:", error)
+			break
+		}
+
+		download, found := downloads[frame.Stream]
+		if !found {
+			continue
+		}
+
+		switch frame.Type {
+
+		case common.FrameHeader:
+
+			if !download.start(frame.Payload) {
+				delete(downloads, frame.Stream)
+			}
+
+		case common.FrameData:
+
+			if download.checksum == nil {
+				continue
+			}
+
+			// The window is only reopened once the rate limit allows,
+			// which holds the server back to the same rate.
+			download.write(frame.Payload)
+			RateBucket.Wait(len(frame.Payload))
+			download.ungranted += len(frame.Payload)
+			if download.ungranted >= kMuxGrant {
+				codec.WriteFrame(writer, common.Frame{Type: common.FrameWindow, Stream: frame.Stream, Payload: []byte(strconv.Itoa(download.ungranted))})
+				download.ungranted = 0
+			}
+
+		case common.FrameEnd:
+
+			if download.checksum != nil {
+				download.finish(frame.Payload)
+			}
+			delete(downloads, frame.Stream)
+
+		case common.FrameReset:
+
+			fmt.Println("The server could not finish sending", download.filename+".")
+			download.abort()
+			delete(downloads, frame.Stream)
+
+		}
+
+	}
+
+	for _, download := range downloads {
+		download.abort()
+	}
+
+	codec.WriteFrame(writer, common.Frame{Type: common.FrameBye})
+	writer.Flush()
+	NetWorkerWG.Done()
+
+	<-ConnLimitSem
+
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kBlockSize       = 128 * 1024
+	kBlockCacheLimit = 64 * 1024 * 1024
+	kTreeTTL         = 5 * time.Second
+
+	// kRangeConns is how many idle connections FetchRange keeps open.
+	kRangeConns = 4
+)
+
+var (
+	ErrRemoteNotFound = errors.New("file not found on server")
+	ErrRemoteChanged  = errors.New("file changed on server")
+)
+
+// RemoteEntry describes a file or directory on the server.
+type RemoteEntry struct {
+	Size     int64
+	Checksum string
+	Dir      bool
+}
+
+// RemoteTree is a cached copy of the server's files, built from its
+// MANIFEST, which unlike the index covers subdirectories and gives sizes.
+// Entries that exist only on this side, such as files created but not yet
+// uploaded and directories with nothing in them, are kept apart in local
+// so that a refresh does not lose them.
+type RemoteTree struct {
+	mutex   sync.Mutex
+	entries map[string]RemoteEntry
+	local   map[string]RemoteEntry
+	fetched time.Time
+}
+
+func NewRemoteTree() *RemoteTree {
+	return &RemoteTree{entries: map[string]RemoteEntry{"": {Dir: true}}, local: make(map[string]RemoteEntry)}
+}
+
+// Refresh fetches the manifest again if the cached copy is older than
+// kTreeTTL, or always if force is set, and adds the local entries the
+// server does not have. On failure the old copy is kept.
+func (tree *RemoteTree) Refresh(force bool) error {
+
+	tree.mutex.Lock()
+	stale := force || time.Since(tree.fetched) > kTreeTTL
+	tree.mutex.Unlock()
+
+	if !stale {
+		return nil
+	}
+
+	lines := GetListing("MANIFEST\n\n", "", "manifest")
+	if lines == nil {
+		return errors.New("cannot fetch manifest")
+	}
+
+	entries := map[string]RemoteEntry{"": {Dir: true}}
+
+	for i := 0; i < len(lines); i++ {
+
+		fields := strings.SplitN(lines[i], " ", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		size, error := strconv.ParseInt(fields[1], 10, 64)
+		if error != nil {
+			continue
+		}
+
+		addEntry(entries, fields[2], RemoteEntry{Size: size, Checksum: fields[0]})
+
+	}
+
+	tree.mutex.Lock()
+	for name, entry := range tree.local {
+		if _, found := entries[name]; !found {
+			addEntry(entries, name, entry)
+		}
+	}
+	tree.entries = entries
+	tree.fetched = time.Now()
+	tree.mutex.Unlock()
+
+	return nil
+
+}
+
+// addEntry adds name and the directories above it to entries.
+func addEntry(entries map[string]RemoteEntry, name string, entry RemoteEntry) {
+	entries[name] = entry
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		entries[dir] = RemoteEntry{Dir: true}
+	}
+}
+
+func (tree *RemoteTree) Lookup(name string) (RemoteEntry, bool) {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	entry, found := tree.entries[name]
+	return entry, found
+}
+
+// Set records a change made through this client, ahead of the next refresh.
+func (tree *RemoteTree) Set(name string, entry RemoteEntry) {
+	tree.mutex.Lock()
+	tree.entries[name] = entry
+	tree.mutex.Unlock()
+}
+
+func (tree *RemoteTree) Remove(name string) {
+	tree.mutex.Lock()
+	delete(tree.entries, name)
+	delete(tree.local, name)
+	tree.mutex.Unlock()
+}
+
+// Keep records an entry that exists only on this side until Forget is
+// called, whatever the manifest says meanwhile.
+func (tree *RemoteTree) Keep(name string, entry RemoteEntry) {
+	tree.mutex.Lock()
+	addEntry(tree.entries, name, entry)
+	tree.local[name] = entry
+	tree.mutex.Unlock()
+}
+
+func (tree *RemoteTree) Forget(name string) {
+	tree.mutex.Lock()
+	delete(tree.local, name)
+	tree.mutex.Unlock()
+}
+
+// Below returns every name inside dir, at any depth.
+func (tree *RemoteTree) Below(dir string) []string {
+
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+
+	names := make([]string, 0)
+	for name := range tree.entries {
+		if strings.HasPrefix(name, dir+"/") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+
+}
+
+// Children returns the names directly inside dir, sorted.
+func (tree *RemoteTree) Children(dir string) []string {
+
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+
+	children := make([]string, 0)
+	for name := range tree.entries {
+		if name == "" {
+			continue
+		}
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		if parent == dir {
+			children = append(children, path.Base(name))
+		}
+	}
+
+	sort.Strings(children)
+	return children
+
+}
+
+// BlockCache keeps recently read blocks of remote files in memory. Blocks
+// are keyed by the content checksum from the manifest, so once a change is
+// noticed no stale block is used, and are fetched on the condition that the
+// file still has that checksum, so no block of newer contents is kept under
+// an older key.
+type BlockCache struct {
+	mutex  sync.Mutex
+	used   int64
+	order  *list.List
+	blocks map[string]*list.Element
+}
+
+type cachedBlock struct {
+	key  string
+	data []byte
+}
+
+func NewBlockCache() *BlockCache {
+	return &BlockCache{order: list.New(), blocks: make(map[string]*list.Element)}
+}
+
+func (cache *BlockCache) get(key string) ([]byte, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, found := cache.blocks[key]
+	if !found {
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(cachedBlock).data, true
+}
+
+func (cache *BlockCache) put(key string, data []byte) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if _, found := cache.blocks[key]; found {
+		return
+	}
+
+	cache.blocks[key] = cache.order.PushFront(cachedBlock{key: key, data: data})
+	cache.used += int64(len(data))
+
+	for cache.used > kBlockCacheLimit && cache.order.Len() > 1 {
+		block := cache.order.Remove(cache.order.Back()).(cachedBlock)
+		delete(cache.blocks, block.key)
+		cache.used -= int64(len(block.data))
+	}
+
+}
+
+// ReadAt reads size bytes at offset of the remote file name, whose contents
+// have checksum, a block at a time through the cache. ErrRemoteChanged is
+// returned once the file no longer has checksum. Without a checksum nothing
+// is cached.
+func (cache *BlockCache) ReadAt(name string, checksum string, offset int64, size int) ([]byte, error) {
+
+	data := make([]byte, 0, size)
+
+	for len(data) < size {
+
+		block := (offset + int64(len(data))) / kBlockSize
+		key := checksum + ":" + strconv.FormatInt(block, 10)
+
+		contents, found := cache.get(key)
+		if !found || checksum == "" {
+			var error error
+			contents, error = FetchRange(name, checksum, block*kBlockSize, kBlockSize)
+			if error != nil {
+				return nil, error
+			}
+			if checksum != "" {
+				cache.put(key, contents)
+			}
+		}
+
+		start := offset + int64(len(data)) - block*kBlockSize
+		if start >= int64(len(contents)) {
+			break
+		}
+		end := start + int64(size-len(data))
+		if end > int64(len(contents)) {
+			end = int64(len(contents))
+		}
+		data = append(data, contents[start:end]...)
+
+		if len(contents) < kBlockSize {
+			break
+		}
+
+	}
+
+	return data, nil
+
+}
+
+// rangeConn is a connection kept open between range requests.
+type rangeConn struct {
+	connx  net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// rangeConns holds the idle range connections.
+var rangeConns = make(chan *rangeConn, kRangeConns)
+
+// FetchRange downloads length bytes of name starting at offset, provided
+// the whole file still has checksum unless that is empty. Less is returned
+// at the end of the file. Connections are reused between calls; one that
+// was idle and turns out to be closed is replaced once.
+func FetchRange(name string, checksum string, offset int64, length int64) ([]byte, error) {
+
+	for {
+
+		var conn *rangeConn
+		reused := true
+
+		select {
+		case conn = <-rangeConns:
+		default:
+			connx, error := DialServer()
+			if error != nil {
+				return nil, error
+			}
+			conn = &rangeConn{connx: connx, reader: bufio.NewReader(connx), writer: bufio.NewWriter(connx)}
+			reused = false
+		}
+
+		data, error := conn.fetch(name, checksum, offset, length)
+		if error == nil || error == ErrRemoteNotFound || error == ErrRemoteChanged {
+			select {
+			case rangeConns <- conn:
+			default:
+				conn.close()
+			}
+			return data, error
+		}
+
+		conn.close()
+		if !reused {
+			return nil, error
+		}
+
+	}
+
+}
+
+// CloseRangeConns closes the idle range connections.
+func CloseRangeConns() {
+	for {
+		select {
+		case conn := <-rangeConns:
+			conn.close()
+		default:
+			return
+		}
+	}
+}
+
+func (conn *rangeConn) close() {
+	conn.writer.WriteString("BYE\n")
+	conn.writer.Flush()
+	conn.connx.Close()
+}
+
+// fetch sends one range request and reads its response, leaving the
+// connection ready for the next.
+func (conn *rangeConn) fetch(name string, checksum string, offset int64, length int64) ([]byte, error) {
+
+	request := "GET " + name + " RANGE " + strconv.FormatInt(offset, 10) + " " + strconv.FormatInt(length, 10)
+	if checksum != "" {
+		request += " IF-MATCH " + checksum
+	}
+	conn.writer.WriteString(request + "\n\n")
+	if flushError := conn.writer.Flush(); flushError != nil {
+		return nil, flushError
+	}
+
+	var bodyLength int64 = -1
+	var refused error
+
+	for {
+
+		line, error := conn.reader.ReadString('\n')
+		if error != nil {
+			return nil, error
+		}
+
+		input := strings.Fields(line)
+		if len(input) == 0 {
+			if bodyLength >= 0 || refused != nil {
+				break
+			}
+			continue
+		}
+
+		switch strings.ToUpper(input[0]) {
+		case "NOTFOUND":
+			refused = ErrRemoteNotFound
+		case "CONFLICT":
+			refused = ErrRemoteChanged
+		case "LENGTH":
+			if len(input) < 2 {
+				return nil, errors.New("invalid LENGTH header")
+			}
+			bodyLength, error = strconv.ParseInt(input[1], 10, 64)
+			if error != nil {
+				return nil, error
+			}
+		case "OK", "CHECKSUM":
+		default:
+			return nil, fmt.Errorf("unexpected response: %s", strings.TrimSpace(line))
+		}
+
+	}
+
+	if refused != nil {
+		return nil, refused
+	}
+
+	data := make([]byte, bodyLength)
+	_, error := io.ReadFull(conn.reader, data)
+	if error != nil {
+		return nil, error
+	}
+
+	for {
+
+		line, error := conn.reader.ReadString('\n')
+		if error != nil {
+			return nil, error
+		}
+
+		input := strings.Fields(line)
+		if len(input) < 2 || input[0] != "CHECKSUM" {
+			continue
+		}
+
+		if input[1] != fmt.Sprintf("%x", md5.Sum(data)) {
+			return nil, errors.New("hash mismatch")
+		}
+		break
+
+	}
+
+	return data, nil
+
+}
+
+// PutFileAs uploads the local file localFile under the remote name and
+// returns the server's response keyword, or "" if the connection failed.
+func PutFileAs(localFile string, name string) string {
+
+	connx, error := DialServer()
+	if error != nil {
+		fmt.Println("Error connecting to server:", error)
+		return ""
+	}
+	defer connx.Close()
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+
+	if !PutRequestSendAs(localFile, name, writer, PutCondition{}) {
+		return ""
+	}
+
+	response := ParsePutResponse(reader)
+
+	writer.WriteString("BYE")
+	writer.Flush()
+
+	return response
+
+}
+
+// DownloadTo fetches the whole of the remote file name, whose contents have
+// checksum, into file.
+func DownloadTo(file *os.File, name string, checksum string, size int64) error {
+
+	for offset := int64(0); offset < size; offset += kBlockSize {
+		data, error := FetchRange(name, checksum, offset, kBlockSize)
+		if error != nil {
+			return error
+		}
+		_, error = file.WriteAt(data, offset)
+		if error != nil {
+			return error
+		}
+	}
+
+	return nil
+
+}
+
+// MountForeground mounts the server at mountpoint until interrupted.
+func MountForeground(mountpoint string) {
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		Unmount()
+	}()
+
+	error := Mount(mountpoint)
+	if error != nil {
+		fmt.Println("Error mounting", mountpoint+":", error)
+	}
+
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"../common"
+)
+
+const kMaxUploadBackoff = 5 * time.Minute
+
+var (
+	UploadDir   string
+	UploadState string
+	UploadDelay time.Duration
+)
+
+// uploadRecord is what the state file remembers about a file's last upload.
+type uploadRecord struct {
+	Checksum string
+	Size     int64
+	ModTime  int64
+}
+
+// LoadUploadState reads the state file, one "<md5> <size> <mtime> <name>"
+// line per file. A missing file is an empty state.
+func LoadUploadState(stateFile string) map[string]uploadRecord {
+
+	state := make(map[string]uploadRecord)
+
+	file, error := os.Open(stateFile)
+	if error != nil {
+		return state
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+
+		fields := strings.SplitN(scanner.Text(), " ", 4)
+		if len(fields) < 4 {
+			continue
+		}
+
+		size, sizeError := strconv.ParseInt(fields[1], 10, 64)
+		modTime, timeError := strconv.ParseInt(fields[2], 10, 64)
+		if sizeError != nil || timeError != nil {
+			continue
+		}
+
+		state[fields[3]] = uploadRecord{Checksum: fields[0], Size: size, ModTime: modTime}
+
+	}
+
+	return state
+
+}
+
+// SaveUploadState replaces the state file, via a rename so that a crash
+// never leaves it half written.
+func SaveUploadState(stateFile string, state map[string]uploadRecord) error {
+
+	temp := stateFile + "-part"
+
+	file, error := os.Create(temp)
+	if error != nil {
+		return error
+	}
+
+	writer := bufio.NewWriter(file)
+	for name, record := range state {
+		writer.WriteString(record.Checksum + " " + strconv.FormatInt(record.Size, 10) + " " + strconv.FormatInt(record.ModTime, 10) + " " + name + "\n")
+	}
+
+	error = writer.Flush()
+	if error == nil {
+		error = file.Sync()
+	}
+	file.Close()
+	if error != nil {
+		os.Remove(temp)
+		return error
+	}
+
+	return os.Rename(temp, stateFile)
+
+}
+
+// changedFiles walks the current directory and returns the files that differ
+// from what was last uploaded, skipping hidden files and any modified within
+// settle, which may still be being written. Files whose contents turn out to
+// be unchanged have their state refreshed instead. records holds what each
+// changed file looked like before it was sent, which is what is remembered
+// once it is uploaded. deferred is true if any file was skipped for being
+// too new, and dirty if state was modified.
+func changedFiles(state map[string]uploadRecord, settle time.Duration) (changed []string, records map[string]uploadRecord, deferred bool, dirty bool) {
+
+	changed = make([]string, 0)
+	records = make(map[string]uploadRecord)
+	seen := make(map[string]bool)
+
+	filepath.Walk(".", func(path string, fileInfo os.FileInfo, err error) error {
+
+		if err != nil {
+			return nil
+		}
+		if path != "." && strings.HasPrefix(fileInfo.Name(), ".") {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+
+		name := filepath.ToSlash(path)
+		seen[name] = true
+
+		record, known := state[name]
+		if known && record.Size == fileInfo.Size() && record.ModTime == fileInfo.ModTime().UnixNano() {
+			return nil
+		}
+
+		if time.Since(fileInfo.ModTime()) < settle {
+			deferred = true
+			return nil
+		}
+
+		current := uploadRecord{Checksum: LocalChecksum(path), Size: fileInfo.Size(), ModTime: fileInfo.ModTime().UnixNano()}
+		if known && current.Checksum != "" && current.Checksum == record.Checksum {
+			state[name] = current
+			dirty = true
+			return nil
+		}
+
+		changed = append(changed, name)
+		records[name] = current
+		return nil
+
+	})
+
+	// Forget deleted files, so they are uploaded again if they come back.
+	for name := range state {
+		if !seen[name] {
+			delete(state, name)
+			dirty = true
+		}
+	}
+
+	return changed, records, deferred, dirty
+
+}
+
+// UploadDaemon watches dir and uploads every new or changed file beneath it
+// with the current transfer mode, forever. Changes are acted on once the
+// directory has been quiet for UploadDelay. Uploads that fail are retried
+// with increasing delays; what has been uploaded is remembered in
+// UploadState, relative to dir, so restarts only send what changed meanwhile.
+func UploadDaemon(dir string) {
+
+	if !ValidEP || ServerAddr == nil {
+		fmt.Println("Error connecting to server:", ErrNoServer)
+		os.Exit(1)
+	}
+
+	error := os.Chdir(dir)
+	if error != nil {
+		fmt.Println("Error opening upload directory:", error)
+		os.Exit(1)
+	}
+
+	state := LoadUploadState(UploadState)
+
+	triggers := make(chan bool, 1)
+	go watchDirectory(".", func() {
+		select {
+		case triggers <- true:
+		default:
+		}
+	})
+
+	fmt.Println("Watching", dir, "for files to upload to", ServerAddr.String()+".")
+
+	backoff := time.Duration(0)
+	notBefore := time.Now()
+	pending := true
+
+	for {
+
+		if !pending {
+			<-triggers
+		}
+
+		// Collapse a burst of changes into one pass once things go quiet,
+		// and never retry failures before their backoff is up.
+		delay := func() time.Duration {
+			if remaining := time.Until(notBefore); remaining > UploadDelay {
+				return remaining
+			}
+			return UploadDelay
+		}
+		timer := time.NewTimer(delay())
+		for quiet := false; !quiet; {
+			select {
+			case <-triggers:
+				timer.Stop()
+				timer = time.NewTimer(delay())
+			case <-timer.C:
+				quiet = true
+			}
+		}
+
+		changed, records, deferred, dirty := changedFiles(state, UploadDelay)
+		pending = deferred
+
+		if len(changed) > 0 {
+
+			results := SendFiles(changed, PutCondition{})
+			dirty = true
+
+			failed := 0
+			for i := 0; i < len(changed); i++ {
+
+				switch results.Outcomes[changed[i]] {
+
+				case "RECV", "EXISTS", "CONFLICT", "REJECTED":
+
+					// Retrying cannot change the server's mind about these
+					// contents; wait until the file changes again. A change
+					// made while it was being sent shows in its mtime.
+					state[changed[i]] = records[changed[i]]
+
+				default:
+					failed++
+
+				}
+
+			}
+
+			if failed > 0 {
+				if backoff == 0 {
+					backoff = UploadDelay
+				} else {
+					backoff *= 2
+				}
+				if backoff > kMaxUploadBackoff {
+					backoff = kMaxUploadBackoff
+				}
+				fmt.Println(failed, "file(s) failed to upload, retrying in", backoff)
+				notBefore = time.Now().Add(backoff)
+				pending = true
+			} else {
+				backoff = 0
+			}
+
+		}
+
+		// Saving touches the directory and so triggers one more, empty, pass.
+		if dirty {
+			error = SaveUploadState(UploadState, state)
+			if error != nil {
+				fmt.Println("Error saving upload state:", error)
+			}
+		}
+
+	}
+
+}
+
+// watchDirectory calls changed whenever something under root may have
+// changed, forever, leaving the caller to rescan and find out what. Without
+// inotify it polls.
+func watchDirectory(root string, changed func()) {
+
+	error := common.WatchDirectory(root, changed)
+	if error != common.ErrWatchUnsupported {
+		fmt.Println("inotify failed, polling for changes:", error)
+	}
+	common.PollDirectory(root, changed)
+
+}
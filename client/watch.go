@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	watchMutex sync.Mutex
+	watchConn  net.Conn
+)
+
+// WatchServer subscribes to changes under path on the server and prints each
+// one until StopWatch is called or the connection drops. With download set,
+// created and modified files are fetched unless the local copy already
+// matches.
+func WatchServer(path string, download bool) {
+
+	connx, error := DialServer()
+	if error != nil {
+		fmt.Println("Error connecting to server:", error)
+		return
+	}
+
+	watchMutex.Lock()
+	if watchConn != nil {
+		watchConn.Close()
+	}
+	watchConn = connx
+	watchMutex.Unlock()
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+
+	writer.WriteString("WATCH " + path + "\n")
+	writer.Flush()
+
+	for {
+
+		line, _, error := reader.ReadLine()
+		if error != nil {
+			break
+		}
+
+		input := strings.Split(string(line), " ")
+
+		switch strings.ToUpper(input[0]) {
+
+		case "WATCHING":
+
+			if path == "" {
+				fmt.Println("Watching all files on the server.")
+			} else {
+				fmt.Println("Watching", path, "on the server.")
+			}
+
+		case "EVENT":
+
+			// EVENT <kind> <name> <size> <md5>; the name may contain spaces.
+			if len(input) < 5 {
+				continue
+			}
+			kind := strings.ToUpper(input[1])
+			name := strings.Join(input[2:len(input)-2], " ")
+			checksum := input[len(input)-1]
+
+			fmt.Println("["+kind+"]", name, input[len(input)-2], "bytes")
+
+			if !download || kind == "DELETED" {
+				continue
+			}
+			if !localName(name) {
+				fmt.Println("Not fetching", name+", which is not a relative name.")
+				continue
+			}
+			if CachedChecksum(name) != checksum && FetchFile(name) {
+				SaveHashCache()
+			}
+
+		case "REQERR":
+
+			fmt.Println("The server does not support watching.")
+
+		}
+
+	}
+
+	watchMutex.Lock()
+	if watchConn == connx {
+		watchConn = nil
+		fmt.Println("Stopped watching the server.")
+	}
+	watchMutex.Unlock()
+
+	connx.Close()
+
+}
+
+// StopWatch ends the running watch, if any, and reports whether there was one.
+func StopWatch() bool {
+
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+
+	if watchConn == nil {
+		return false
+	}
+
+	watchConn.Close()
+	watchConn = nil
+	fmt.Println("Stopped watching the server.")
+	return true
+
+}
+
+// FetchFile downloads one file on its own connection, creating any local
+// directories its name requires.
+func FetchFile(filename string) bool {
+
+	if dir := filepath.Dir(filename); dir != "." {
+		os.MkdirAll(dir, 0755)
+	}
+
+	connx, error := DialServer()
+	if error != nil {
+		fmt.Println("Error connecting to server:", error)
+		return false
+	}
+	defer connx.Close()
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+
+	writer.WriteString(GetRequestLine(filename) + "\n")
+	writer.Flush()
+
+	success := ParseGetResponse(filename, reader)
+
+	writer.WriteString("BYE")
+	writer.Flush()
+
+	return success
+
+}
+
+// LocalChecksum returns the hex MD5 of a local file, or "" if it cannot be
+// read.
+func LocalChecksum(filename string) string {
+
+	file, error := os.Open(filename)
+	if error != nil {
+		return ""
+	}
+	defer file.Close()
+
+	checksum := md5.New()
+	_, error = io.Copy(checksum, file)
+	if error != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", checksum.Sum(make([]byte, 0)))
+
+}
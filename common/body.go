@@ -0,0 +1,104 @@
+package common
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	// BufferSize is the size of the buffers bodies are copied through, set
+	// with -buffer-size before the first body is copied. Connections keep
+	// bufio's default buffers for their request and response lines; reads
+	// and writes of a whole buffer go past those directly.
+	BufferSize = 256 * 1024
+
+	bodyBuffers = sync.Pool{New: func() interface{} {
+		buffer := make([]byte, BufferSize)
+		return &buffer
+	}}
+)
+
+// rateReader charges everything read through it against its buckets.
+type rateReader struct {
+	reader  io.Reader
+	buckets []*TokenBucket
+}
+
+func (limited *rateReader) Read(p []byte) (int, error) {
+	n, err := limited.reader.Read(p)
+	WaitAll(n, limited.buckets...)
+	return n, err
+}
+
+// DrainWriter passes writes on to Dest until one fails, then discards the
+// rest so the body can still be read to its end. The failure is kept in Err.
+type DrainWriter struct {
+	Dest io.Writer
+	Err  error
+}
+
+func (drain *DrainWriter) Write(p []byte) (int, error) {
+	if drain.Err == nil {
+		_, drain.Err = drain.Dest.Write(p)
+	}
+	return len(p), nil
+}
+
+// ReceiveBody reads a body of exactly length bytes from reader into dest,
+// charging it against buckets, and returns its checksum. The body is read in
+// full even if writing to dest fails, so the connection stays in step with
+// the peer; that failure is returned as writeErr. err is set only if the
+// body could not be read, in which case the connection is unusable.
+func ReceiveBody(reader io.Reader, dest io.Writer, length int64, buckets ...*TokenBucket) (checksum string, writeErr error, err error) {
+
+	buffer := bodyBuffers.Get().(*[]byte)
+	defer bodyBuffers.Put(buffer)
+
+	hash := md5.New()
+	drain := &DrainWriter{Dest: dest}
+	source := &rateReader{reader: io.LimitReader(reader, length), buckets: buckets}
+
+	received, err := io.CopyBuffer(io.MultiWriter(hash, drain), source, *buffer)
+	if err == nil && received < length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", drain.Err, err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), drain.Err, nil
+
+}
+
+// SendBody writes the contents of reader to writer, charging it against
+// buckets, and returns how many bytes were sent and their checksum.
+func SendBody(writer io.Writer, reader io.Reader, buckets ...*TokenBucket) (int64, string, error) {
+
+	buffer := bodyBuffers.Get().(*[]byte)
+	defer bodyBuffers.Put(buffer)
+
+	hash := md5.New()
+	source := &rateReader{reader: reader, buckets: buckets}
+
+	sent, err := io.CopyBuffer(io.MultiWriter(hash, writer), source, *buffer)
+	if err != nil {
+		return sent, "", err
+	}
+
+	return sent, fmt.Sprintf("%x", hash.Sum(nil)), nil
+
+}
+
+// CopyBody copies length bytes from reader to writer through a body buffer,
+// for writers that cannot read from a file themselves.
+func CopyBody(writer io.Writer, reader io.Reader, length int64) (int64, error) {
+
+	buffer := bodyBuffers.Get().(*[]byte)
+	defer bodyBuffers.Put(buffer)
+
+	// Hiding the writer's ReadFrom keeps io.CopyBuffer on our buffer.
+	return io.CopyBuffer(struct{ io.Writer }{writer}, io.LimitReader(reader, length), *buffer)
+
+}
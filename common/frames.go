@@ -0,0 +1,147 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Frame types of a multiplexed connection, as described in Spec.text.
+const (
+	FrameRequest = "REQ"
+	FrameHeader  = "HEAD"
+	FrameData    = "DATA"
+	FrameEnd     = "END"
+	FrameWindow  = "WINDOW"
+	FrameReset   = "RESET"
+	FrameBye     = "BYE"
+)
+
+// Frame is one unit of a multiplexed connection.
+type Frame struct {
+	Type    string
+	Stream  uint32
+	Payload []byte
+}
+
+// FrameCodec is a wire format for frames. The text format is used after MUX
+// and the binary one after FRAMING BINARY; frames mean the same in both.
+// Each side sets the largest payload it accepts from the other.
+type FrameCodec interface {
+	ReadFrame(reader *bufio.Reader) (Frame, error)
+	WriteFrame(writer *bufio.Writer, frame Frame) error
+}
+
+// TextFrames sends each frame as a "<type> <stream> <length>" line followed
+// by length bytes of payload.
+type TextFrames struct {
+	MaxPayload uint32
+}
+
+func (codec TextFrames) ReadFrame(reader *bufio.Reader) (Frame, error) {
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return Frame{}, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return Frame{}, fmt.Errorf("invalid frame header %q", strings.TrimSpace(line))
+	}
+
+	stream, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return Frame{}, fmt.Errorf("invalid frame header %q", strings.TrimSpace(line))
+	}
+	length, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil || length > uint64(codec.MaxPayload) {
+		return Frame{}, fmt.Errorf("invalid frame header %q", strings.TrimSpace(line))
+	}
+
+	frame := Frame{Type: strings.ToUpper(fields[0]), Stream: uint32(stream), Payload: make([]byte, length)}
+	_, err = io.ReadFull(reader, frame.Payload)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return frame, nil
+
+}
+
+func (TextFrames) WriteFrame(writer *bufio.Writer, frame Frame) error {
+
+	writer.WriteString(frame.Type + " " + strconv.FormatUint(uint64(frame.Stream), 10) + " " + strconv.Itoa(len(frame.Payload)) + "\n")
+	_, err := writer.Write(frame.Payload)
+	return err
+
+}
+
+// BinaryFrames sends each frame as a fixed 9 byte header, the type code,
+// then the stream and the payload length as big-endian 32 bit integers,
+// followed by the payload.
+type BinaryFrames struct {
+	MaxPayload uint32
+}
+
+const kBinaryFrameHeader = 9
+
+var (
+	binaryFrameCodes = map[string]byte{
+		FrameRequest: 1,
+		FrameHeader:  2,
+		FrameData:    3,
+		FrameEnd:     4,
+		FrameWindow:  5,
+		FrameReset:   6,
+		FrameBye:     7,
+	}
+	binaryFrameTypes = make(map[byte]string)
+)
+
+func init() {
+	for frameType, code := range binaryFrameCodes {
+		binaryFrameTypes[code] = frameType
+	}
+}
+
+// ReadFrame returns frames of an unknown type with an empty Type, so that
+// they are skipped like unknown text frames.
+func (codec BinaryFrames) ReadFrame(reader *bufio.Reader) (Frame, error) {
+
+	var header [kBinaryFrameHeader]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > codec.MaxPayload {
+		return Frame{}, fmt.Errorf("frame of %d bytes is too large", length)
+	}
+
+	frame := Frame{Type: binaryFrameTypes[header[0]], Stream: binary.BigEndian.Uint32(header[1:5]), Payload: make([]byte, length)}
+	_, err = io.ReadFull(reader, frame.Payload)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return frame, nil
+
+}
+
+func (BinaryFrames) WriteFrame(writer *bufio.Writer, frame Frame) error {
+
+	var header [kBinaryFrameHeader]byte
+	header[0] = binaryFrameCodes[frame.Type]
+	binary.BigEndian.PutUint32(header[1:5], frame.Stream)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(frame.Payload)))
+
+	writer.Write(header[:])
+	_, err := writer.Write(frame.Payload)
+	return err
+
+}
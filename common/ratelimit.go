@@ -0,0 +1,118 @@
+// Package common holds the code shared by the client and the server.
+package common
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits throughput to a fixed number of bytes per second.
+// Tokens accumulate up to one second's worth of traffic. A nil bucket, or
+// one with a rate of zero, never blocks.
+type TokenBucket struct {
+	mutex    sync.Mutex
+	rate     int64
+	tokens   int64
+	lastFill time.Time
+}
+
+func NewTokenBucket(rate int64) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &TokenBucket{rate: rate, tokens: rate, lastFill: time.Now()}
+}
+
+// SetRate changes the rate of a bucket that may be in use. A rate of zero
+// lifts the limit.
+func (bucket *TokenBucket) SetRate(rate int64) {
+
+	bucket.mutex.Lock()
+	bucket.rate = rate
+	bucket.tokens = rate
+	bucket.lastFill = time.Now()
+	bucket.mutex.Unlock()
+
+}
+
+// Wait blocks until n bytes may be transferred. Requests larger than the
+// bucket are allowed through and paid back by sleeping off the deficit.
+func (bucket *TokenBucket) Wait(n int) {
+
+	if bucket == nil || n <= 0 {
+		return
+	}
+
+	bucket.mutex.Lock()
+
+	if bucket.rate <= 0 {
+		bucket.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	bucket.tokens += int64(now.Sub(bucket.lastFill).Seconds() * float64(bucket.rate))
+	if bucket.tokens > bucket.rate {
+		bucket.tokens = bucket.rate
+	}
+	bucket.lastFill = now
+	bucket.tokens -= int64(n)
+
+	var delay time.Duration
+	if bucket.tokens < 0 {
+		delay = time.Duration(float64(-bucket.tokens) / float64(bucket.rate) * float64(time.Second))
+	}
+
+	bucket.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+}
+
+// WaitAll charges n bytes against every bucket in turn.
+func WaitAll(n int, buckets ...*TokenBucket) {
+	for i := 0; i < len(buckets); i++ {
+		buckets[i].Wait(n)
+	}
+}
+
+// ParseRate accepts a byte rate such as "512", "64k" or "10M".
+func ParseRate(rate string) (int64, error) {
+
+	multiplier := int64(1)
+	rate = strings.TrimSpace(rate)
+
+	if len(rate) > 0 {
+		switch strings.ToLower(rate[len(rate)-1:]) {
+		case "k":
+			multiplier = 1024
+		case "m":
+			multiplier = 1048576
+		case "g":
+			multiplier = 1073741824
+		}
+		if multiplier > 1 {
+			rate = rate[:len(rate)-1]
+		}
+	}
+
+	value, err := strconv.ParseInt(rate, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 {
+		return 0, errors.New("rate must not be negative")
+	}
+	if value > math.MaxInt64/multiplier {
+		return 0, errors.New("rate is out of range")
+	}
+
+	return value * multiplier, nil
+
+}
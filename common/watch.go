@@ -0,0 +1,19 @@
+package common
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrWatchUnsupported is returned by WatchDirectory where there is no
+// inotify.
+var ErrWatchUnsupported = errors.New("directory watching is not supported on this system")
+
+// PollDirectory calls changed every second, forever, leaving the caller to
+// rescan and find out what actually changed.
+func PollDirectory(root string, changed func()) {
+	for {
+		time.Sleep(time.Second)
+		changed()
+	}
+}
@@ -0,0 +1,83 @@
+//go:build linux
+
+package common
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const kInotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// WatchDirectory calls changed whenever inotify reports activity anywhere
+// under root, adding watches for new subdirectories as they appear. Hidden
+// directories are not watched. It only returns if inotify is unavailable or
+// fails, leaving the caller to fall back to PollDirectory.
+func WatchDirectory(root string, changed func()) error {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	watchedPaths := make(map[string]int32)
+	watchedDescriptors := make(map[int32]string)
+
+	addWatches := func() {
+		filepath.Walk(root, func(path string, fileInfo os.FileInfo, err error) error {
+			if err != nil || !fileInfo.IsDir() {
+				return nil
+			}
+			if path != root && strings.HasPrefix(fileInfo.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if _, watched := watchedPaths[path]; !watched {
+				wd, err := syscall.InotifyAddWatch(fd, path, kInotifyMask)
+				if err == nil {
+					watchedPaths[path] = int32(wd)
+					watchedDescriptors[int32(wd)] = path
+				}
+			}
+			return nil
+		})
+	}
+
+	addWatches()
+
+	buffer := make([]byte, 64*1024)
+
+	for {
+
+		n, err := syscall.Read(fd, buffer)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		} else if n <= 0 {
+			return syscall.EIO
+		}
+
+		// Forget directories that have gone, so a new one at the same path
+		// is watched afresh.
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buffer[offset:]))
+			mask := binary.NativeEndian.Uint32(buffer[offset+4:])
+			nameLength := int(binary.NativeEndian.Uint32(buffer[offset+12:]))
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(watchedPaths, watchedDescriptors[wd])
+				delete(watchedDescriptors, wd)
+			}
+			offset += syscall.SizeofInotifyEvent + nameLength
+		}
+
+		addWatches()
+		changed()
+
+	}
+
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package common
+
+// WatchDirectory is only implemented with inotify.
+func WatchDirectory(root string, changed func()) error {
+	return ErrWatchUnsupported
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log. Hash covers the JSON encoding
+// of the entry with Hash left empty, and Prev holds the previous entry's
+// Hash, so editing, removing or reordering any line breaks the chain.
+type AuditEntry struct {
+	Seq      int64  `json:"seq"`
+	Time     string `json:"time"`
+	Conn     int64  `json:"conn"`
+	Remote   string `json:"remote"`
+	Verb     string `json:"verb"`
+	File     string `json:"file"`
+	Outcome  string `json:"outcome"`
+	Bytes    int64  `json:"bytes"`
+	Checksum string `json:"checksum,omitempty"`
+	Prev     string `json:"prev"`
+	Hash     string `json:"hash"`
+}
+
+// AuditLog is an append-only, hash-chained record of file operations.
+type AuditLog struct {
+	mutex    sync.Mutex
+	file     *os.File
+	seq      int64
+	lastHash string
+}
+
+var Audit *AuditLog
+
+// The first entry in a log chains from this value.
+const kAuditGenesis = "0000000000000000000000000000000000000000000000000000000000000000"
+
+func (entry AuditEntry) computeHash() string {
+	entry.Hash = ""
+	encoded, _ := json.Marshal(entry)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// OpenAuditLog opens path for appending, verifying any existing entries so
+// new ones continue the chain.
+func OpenAuditLog(path string) (*AuditLog, error) {
+
+	seq, lastHash, err := VerifyAuditLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditLog{file: file, seq: seq, lastHash: lastHash}, nil
+
+}
+
+// Append writes entry to the log, filling in its sequence number, time and
+// chain hashes. The entry is synced to disk before Append returns.
+func (audit *AuditLog) Append(entry AuditEntry) error {
+
+	if audit == nil {
+		return nil
+	}
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	entry.Seq = audit.seq + 1
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	entry.Prev = audit.lastHash
+	entry.Hash = entry.computeHash()
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = audit.file.Write(append(encoded, '\n'))
+	if err != nil {
+		return err
+	}
+
+	err = audit.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	audit.seq = entry.Seq
+	audit.lastHash = entry.Hash
+	return nil
+
+}
+
+// VerifyAuditLog walks the chain in path and returns the sequence number and
+// hash of the last entry, or an error describing the first broken link.
+func VerifyAuditLog(path string) (int64, string, error) {
+
+	var seq int64
+	lastHash := kAuditGenesis
+
+	file, err := os.Open(path)
+	if err != nil {
+		return seq, lastHash, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+
+		line++
+
+		var entry AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return seq, lastHash, fmt.Errorf("line %d: malformed entry: %v", line, err)
+		}
+
+		if entry.Seq != seq+1 {
+			return seq, lastHash, fmt.Errorf("line %d: expected sequence %d, found %d", line, seq+1, entry.Seq)
+		}
+
+		if entry.Prev != lastHash {
+			return seq, lastHash, fmt.Errorf("line %d: chain broken, previous hash does not match", line)
+		}
+
+		if entry.computeHash() != entry.Hash {
+			return seq, lastHash, fmt.Errorf("line %d: entry hash does not match contents", line)
+		}
+
+		seq = entry.Seq
+		lastHash = entry.Hash
+
+	}
+
+	if err := scanner.Err(); err != nil {
+		return seq, lastHash, err
+	}
+
+	return seq, lastHash, nil
+
+}
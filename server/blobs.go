@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const kBlobsDir = "files/.blobs"
+
+var (
+	// StoreBackend is "plain", where every name is an independent file, or
+	// "cas", where contents live once in the blob area under their SHA-256
+	// and names are hard links to them.
+	StoreBackend string
+
+	ErrNoBlob = errors.New("no stored blob with that checksum")
+
+	// liveBlobs maps a blob to the name in files/ last known to link to it.
+	// LINK only offers blobs that still have such a name, so contents kept
+	// only as versions or in the trash are not handed out again.
+	liveBlobMutex sync.Mutex
+	liveBlobs     = make(map[string]string)
+)
+
+// BlobPath is where contents with the given hex SHA-256 are kept. Anything
+// that is not a well-formed digest is rejected.
+func BlobPath(digest string) (string, bool) {
+	decoded, err := hex.DecodeString(digest)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", false
+	}
+	return filepath.Join(kBlobsDir, strings.ToLower(digest)), true
+}
+
+// BlobDigest returns the hex SHA-256 of the file at localFile, which names
+// its blob.
+func BlobDigest(localFile string) (string, error) {
+
+	file, err := os.Open(localFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	_, err = io.Copy(digest, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(digest.Sum(nil)), nil
+
+}
+
+// storeBlob moves a committed temporary file into the blob area, or drops it
+// if identical contents are already there, and returns the blob's path.
+func storeBlob(tempName string, digest string) (string, error) {
+
+	blobPath, valid := BlobPath(digest)
+	if !valid {
+		return "", ErrNoBlob
+	}
+
+	err := os.MkdirAll(kBlobsDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = os.Lstat(blobPath)
+	if err == nil {
+		return blobPath, os.Remove(tempName)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	err = os.Rename(tempName, blobPath)
+	if err != nil {
+		return "", err
+	}
+
+	return blobPath, SyncDir(kBlobsDir)
+
+}
+
+// placeBlob points localFile at blobPath by hard-linking it under a
+// temporary name and renaming that into place, so readers never see the
+// name missing. Callers hold commitMutex.
+func placeBlob(blobPath string, localFile string) error {
+
+	linkName := filepath.Join(filepath.Dir(localFile), "."+filepath.Base(localFile)+"-link")
+	os.Remove(linkName)
+
+	err := os.Link(blobPath, linkName)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(linkName, localFile)
+	if err != nil {
+		os.Remove(linkName)
+		return err
+	}
+
+	liveBlobMutex.Lock()
+	liveBlobs[blobPath] = localFile
+	liveBlobMutex.Unlock()
+
+	return nil
+
+}
+
+// liveBlob returns the blob with the given digest and length if a name in
+// files/ still links to it.
+func liveBlob(digest string, length int64) (string, bool) {
+
+	blobPath, valid := BlobPath(digest)
+	if !valid {
+		return "", false
+	}
+
+	blobInfo, err := os.Lstat(blobPath)
+	if err != nil || blobInfo.Size() != length {
+		return "", false
+	}
+
+	liveBlobMutex.Lock()
+	localFile, found := liveBlobs[blobPath]
+	liveBlobMutex.Unlock()
+	if !found {
+		return "", false
+	}
+
+	fileInfo, err := os.Lstat(localFile)
+	if err != nil || !os.SameFile(fileInfo, blobInfo) {
+		liveBlobMutex.Lock()
+		if liveBlobs[blobPath] == localFile {
+			delete(liveBlobs, blobPath)
+		}
+		liveBlobMutex.Unlock()
+		return "", false
+	}
+
+	return blobPath, true
+
+}
+
+// IndexBlobs finds a name in files/ for every blob that has one. It runs
+// once at startup; names placed later are recorded by placeBlob. A name
+// that has since been moved or replaced only costs a client a full upload.
+func IndexBlobs() error {
+
+	entries, err := ioutil.ReadDir(kBlobsDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	blobs := make(map[uint64]string)
+	for i := 0; i < len(entries); i++ {
+		if inode := fileInode(entries[i]); inode != 0 && linkCount(entries[i]) > 1 {
+			blobs[inode] = filepath.Join(kBlobsDir, entries[i].Name())
+		}
+	}
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	return filepath.Walk(kFilesDir, func(localFile string, fileInfo os.FileInfo, err error) error {
+
+		if err != nil {
+			return nil
+		}
+
+		name, _ := filepath.Rel(kFilesDir, localFile)
+		if fileInfo.IsDir() && name != "." && IsReservedName(name) {
+			return filepath.SkipDir
+		}
+
+		if blobPath, found := blobs[fileInode(fileInfo)]; found && fileInfo.Mode().IsRegular() {
+			liveBlobMutex.Lock()
+			liveBlobs[blobPath] = localFile
+			liveBlobMutex.Unlock()
+		}
+		return nil
+
+	})
+
+}
+
+// FindBlob returns the path of stored contents with the given SHA-256 and
+// length, if the server holds them under some name.
+func FindBlob(digest string, length int64) (string, bool) {
+
+	if StoreBackend != "cas" {
+		return "", false
+	}
+
+	return liveBlob(digest, length)
+
+}
+
+// LinkBlob stores name as a reference to existing contents with the given
+// SHA-256 and length, without any data being sent. It returns ErrNoBlob if
+// the server does not hold such contents under some name, and otherwise
+// behaves like CommitFile.
+func LinkBlob(name string, digest string, length int64, condition PutCondition) error {
+
+	if StoreBackend != "cas" {
+		return ErrNoBlob
+	}
+
+	localFile := StorePath(name)
+
+	if !condition.checked {
+		err := CheckCondition(localFile, &condition)
+		if err != nil {
+			return err
+		}
+	}
+
+	commitMutex.Lock()
+
+	blobPath, found := liveBlob(digest, length)
+	if !found {
+		commitMutex.Unlock()
+		return ErrNoBlob
+	}
+
+	err := confirmCondition(localFile, condition)
+	if err == nil {
+		err = PreserveReplaced(localFile, name)
+	}
+	if err == nil {
+		err = placeBlob(blobPath, localFile)
+	}
+
+	commitMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return SyncDir(filepath.Dir(localFile))
+
+}
+
+// CollectBlobs removes blobs that no name or version refers to any more.
+func CollectBlobs() {
+
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	entries, err := ioutil.ReadDir(kBlobsDir)
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < len(entries); i++ {
+		if linkCount(entries[i]) == 1 {
+			os.Remove(filepath.Join(kBlobsDir, entries[i].Name()))
+		}
+	}
+
+}
+
+// CollectBlobsEvery runs CollectBlobs periodically, forever.
+func CollectBlobsEvery(interval time.Duration) {
+	for {
+		CollectBlobs()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// linkCount is unknown on this platform, so blobs are never collected.
+func linkCount(fileInfo os.FileInfo) uint64 {
+	return 0
+}
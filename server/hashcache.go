@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HashCache remembers the checksums of stored files, so they can be sent
+// ahead of a body, listed, and compared without reading the file again. An
+// entry is only used while the file's size, modification time and inode are
+// unchanged. If the cache has a sidecar file at path, entries are appended
+// to it as they are computed and survive a restart.
+type HashCache struct {
+	mutex   sync.Mutex
+	entries map[string]hashEntry
+	path    string
+	sidecar *os.File
+}
+
+type hashEntry struct {
+	size     int64
+	modTime  int64
+	inode    uint64
+	checksum string
+}
+
+// HashCachePath is the sidecar of the server's hash cache, kept in the files
+// directory as a hidden file. The cache is only in memory if it is empty.
+var (
+	HashCachePath string
+	Hashes        = NewHashCache()
+)
+
+func NewHashCache() *HashCache {
+	return &HashCache{entries: make(map[string]hashEntry)}
+}
+
+func newHashEntry(fileInfo os.FileInfo, checksum string) hashEntry {
+	return hashEntry{
+		size:     fileInfo.Size(),
+		modTime:  fileInfo.ModTime().UnixNano(),
+		inode:    fileInode(fileInfo),
+		checksum: checksum,
+	}
+}
+
+// OpenHashCache loads the sidecar at path, which has one line per entry,
+// "<md5> <size> <mtime ns> <inode> <path>", later lines replacing earlier
+// ones. Entries for files that have since changed are dropped, and the
+// sidecar is rewritten without them before new entries are appended.
+func OpenHashCache(path string) (*HashCache, error) {
+
+	cache := NewHashCache()
+
+	file, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.SplitN(scanner.Text(), " ", 5)
+			if len(fields) < 5 {
+				continue
+			}
+			size, sizeErr := strconv.ParseInt(fields[1], 10, 64)
+			modTime, timeErr := strconv.ParseInt(fields[2], 10, 64)
+			inode, inodeErr := strconv.ParseUint(fields[3], 10, 64)
+			if sizeErr != nil || timeErr != nil || inodeErr != nil {
+				continue
+			}
+			cache.entries[fields[4]] = hashEntry{size: size, modTime: modTime, inode: inode, checksum: fields[0]}
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cache.path = path
+	err = cache.Prune()
+	if err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+
+}
+
+// Prune drops the entries of files that were deleted or changed since they
+// were hashed, and rewrites the sidecar with the rest; otherwise both would
+// keep every checksum ever computed. Files are checked without the lock.
+func (cache *HashCache) Prune() error {
+
+	cache.mutex.Lock()
+	entries := make(map[string]hashEntry, len(cache.entries))
+	for localFile, entry := range cache.entries {
+		entries[localFile] = entry
+	}
+	cache.mutex.Unlock()
+
+	stale := make([]string, 0)
+	for localFile, entry := range entries {
+		fileInfo, err := os.Stat(localFile)
+		if err != nil || newHashEntry(fileInfo, entry.checksum) != entry {
+			stale = append(stale, localFile)
+		}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	// An entry replaced meanwhile is for the file as it is now.
+	for i := 0; i < len(stale); i++ {
+		if cache.entries[stale[i]] == entries[stale[i]] {
+			delete(cache.entries, stale[i])
+		}
+	}
+
+	if cache.path == "" {
+		return nil
+	}
+	return cache.rewrite()
+
+}
+
+// rewrite replaces the sidecar with one holding only the current entries.
+// Callers hold the mutex.
+func (cache *HashCache) rewrite() error {
+
+	temp, err := ioutil.TempFile(filepath.Dir(cache.path), ".hashes-")
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(temp)
+	for localFile, entry := range cache.entries {
+		writer.WriteString(formatHashEntry(localFile, entry))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = os.Rename(temp.Name(), cache.path)
+	}
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if cache.sidecar != nil {
+		cache.sidecar.Close()
+	}
+	cache.sidecar = temp
+	return nil
+
+}
+
+// PruneHashesEvery prunes the server's hash cache periodically, forever.
+func PruneHashesEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := Hashes.Prune()
+		if err != nil {
+			Log.Warn("error pruning hash cache", "error", err)
+		}
+	}
+}
+
+func formatHashEntry(localFile string, entry hashEntry) string {
+	return entry.checksum + " " + strconv.FormatInt(entry.size, 10) + " " +
+		strconv.FormatInt(entry.modTime, 10) + " " +
+		strconv.FormatUint(entry.inode, 10) + " " + localFile + "\n"
+}
+
+// Lookup returns the cached checksum of localFile, whose details are
+// fileInfo, if it is still current.
+func (cache *HashCache) Lookup(localFile string, fileInfo os.FileInfo) (string, bool) {
+
+	cache.mutex.Lock()
+	entry, found := cache.entries[localFile]
+	cache.mutex.Unlock()
+
+	if !found || newHashEntry(fileInfo, entry.checksum) != entry {
+		return "", false
+	}
+	return entry.checksum, true
+
+}
+
+// Checksum returns the MD5 of the open file at localFile, whose details are
+// fileInfo, hashing it only if the cache has no current entry. The file is
+// read with ReadAt, so its offset is left alone.
+func (cache *HashCache) Checksum(localFile string, file *os.File, fileInfo os.FileInfo) (string, error) {
+
+	if checksum, found := cache.Lookup(localFile, fileInfo); found {
+		return checksum, nil
+	}
+
+	checksum, err := RangeChecksum(file, 0, fileInfo.Size())
+	if err != nil {
+		return "", err
+	}
+
+	entry := newHashEntry(fileInfo, checksum)
+
+	cache.mutex.Lock()
+	cache.entries[localFile] = entry
+	if cache.sidecar != nil {
+		_, err = cache.sidecar.WriteString(formatHashEntry(localFile, entry))
+		if err != nil {
+			Log.Warn("error writing hash cache, continuing without it", "file", cache.sidecar.Name(), "error", err)
+			cache.sidecar.Close()
+			cache.sidecar = nil
+		}
+	}
+	cache.mutex.Unlock()
+
+	return checksum, nil
+
+}
+
+// RangeChecksum hashes length bytes of file from offset.
+func RangeChecksum(file *os.File, offset int64, length int64) (string, error) {
+
+	checksum := md5.New()
+	_, err := io.Copy(checksum, io.NewSectionReader(file, offset, length))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", checksum.Sum(nil)), nil
+
+}
+
+// RangeMatches reports whether the file a ranged GET opened still has the
+// whole-file checksum its IF-MATCH names, so that a client caching blocks
+// by that checksum is never sent a block of other contents. A request
+// without IF-MATCH always matches; one that cannot be checked does not.
+func RangeMatches(request GetRequest, localFile string, file *os.File, fileInfo os.FileInfo) bool {
+
+	if request.IfMatch == "" {
+		return true
+	}
+
+	checksum, err := Hashes.Checksum(localFile, file, fileInfo)
+	return err == nil && checksum == request.IfMatch
+
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// fileInode is unknown on this platform, so hash cache entries are keyed by
+// size and modification time alone.
+func fileInode(fileInfo os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashCachePrune(t *testing.T) {
+
+	dir := t.TempDir()
+	sidecar := filepath.Join(dir, ".hashes")
+
+	cache, err := OpenHashCache(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := func(name string) {
+		t.Helper()
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		fileInfo, _ := file.Stat()
+		_, err = cache.Checksum(file.Name(), file, fileInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"kept", "deleted", "changed"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		checksum(name)
+	}
+	// Hashing the same unchanged file twice appends it twice.
+	checksum("kept")
+
+	os.Remove(filepath.Join(dir, "deleted"))
+	ioutil.WriteFile(filepath.Join(dir, "changed"), []byte("changed again"), 0644)
+
+	err = cache.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cache.entries) != 1 {
+		t.Fatalf("cache holds %d entries after pruning, want 1", len(cache.entries))
+	}
+	if _, found := cache.entries[filepath.Join(dir, "kept")]; !found {
+		t.Fatal("pruning dropped an unchanged file")
+	}
+
+	data, err := ioutil.ReadFile(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], " "+filepath.Join(dir, "kept")) {
+		t.Fatalf("sidecar after pruning is %q", data)
+	}
+
+	// New entries go to the rewritten sidecar.
+	ioutil.WriteFile(filepath.Join(dir, "added"), []byte("added"), 0644)
+	checksum("added")
+
+	reopened, err := OpenHashCache(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.entries) != 2 {
+		t.Fatalf("reopened cache holds %d entries, want 2", len(reopened.entries))
+	}
+
+}
+
+// BenchmarkChecksum compares hashing a file with finding its checksum in
+// the cache, as every GET, STAT and conditional request of an unchanged
+// file does.
+func BenchmarkChecksum(b *testing.B) {
+
+	file := benchFile(b)
+	fileInfo, _ := file.Stat()
+
+	b.Run("hashed", func(b *testing.B) {
+		b.SetBytes(fileInfo.Size())
+		for i := 0; i < b.N; i++ {
+			_, err := NewHashCache().Checksum(file.Name(), file, fileInfo)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		cache := NewHashCache()
+		cache.Checksum(file.Name(), file, fileInfo)
+		b.SetBytes(fileInfo.Size())
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := cache.Checksum(file.Name(), file, fileInfo)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+}
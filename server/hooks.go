@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HookEvent describes a transfer to hooks. Path is where the stored contents
+// can be read. Pre-PUT hooks run before an upload's body is received, so for
+// them Path and Checksum are empty except on LINK, whose contents are
+// already stored.
+type HookEvent struct {
+	Verb     string
+	Name     string
+	Path     string
+	Size     int64
+	Checksum string
+	Remote   string
+}
+
+// PrePutHook inspects an upload before it is stored. Returning an error
+// rejects the upload, and the error's text is sent to the client as the
+// reason.
+type PrePutHook func(event HookEvent) error
+
+// HookRejection is returned by RunPrePutHooks when a hook refuses an upload.
+type HookRejection struct {
+	Reason string
+}
+
+func (rejection *HookRejection) Error() string {
+	return "upload rejected: " + rejection.Reason
+}
+
+// PostHook is told about a completed transfer. Post hooks run after the
+// client has its response and cannot affect the outcome.
+type PostHook func(event HookEvent)
+
+// kMaxPostHooks is how many post hooks may run at once. Transfers that
+// finish while all are busy wait for one to end before starting theirs.
+const kMaxPostHooks = 16
+
+var (
+	hookMutex    sync.RWMutex
+	prePutHooks  []PrePutHook
+	postPutHooks []PostHook
+	postGetHooks []PostHook
+
+	postHookSlots = make(chan bool, kMaxPostHooks)
+
+	HookTimeout time.Duration
+)
+
+func RegisterPrePutHook(hook PrePutHook) {
+	hookMutex.Lock()
+	prePutHooks = append(prePutHooks, hook)
+	hookMutex.Unlock()
+}
+
+func RegisterPostPutHook(hook PostHook) {
+	hookMutex.Lock()
+	postPutHooks = append(postPutHooks, hook)
+	hookMutex.Unlock()
+}
+
+func RegisterPostGetHook(hook PostHook) {
+	hookMutex.Lock()
+	postGetHooks = append(postGetHooks, hook)
+	hookMutex.Unlock()
+}
+
+// RunPrePutHooks runs every pre-PUT hook in registration order and returns
+// the first rejection as a *HookRejection.
+func RunPrePutHooks(event HookEvent) error {
+
+	hookMutex.RLock()
+	hooks := prePutHooks
+	hookMutex.RUnlock()
+
+	for i := 0; i < len(hooks); i++ {
+		err := hooks[i](event)
+		if err != nil {
+			return &HookRejection{Reason: err.Error()}
+		}
+	}
+
+	return nil
+
+}
+
+// RunPostHooks runs hooks for event in the background, once one of the
+// kMaxPostHooks slots is free.
+func RunPostHooks(verb string, event HookEvent) {
+
+	hookMutex.RLock()
+	hooks := postPutHooks
+	if verb == "GET" {
+		hooks = postGetHooks
+	}
+	hookMutex.RUnlock()
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	postHookSlots <- true
+	go func() {
+		for i := 0; i < len(hooks); i++ {
+			hooks[i](event)
+		}
+		<-postHookSlots
+	}()
+
+}
+
+// runHookCommand executes program with the event's name, size and checksum
+// as arguments, - standing for a checksum not yet known, and the whole event
+// in TCPFT_* environment variables. It returns the first line of the
+// program's output alongside any error.
+func runHookCommand(program string, event HookEvent) (string, error) {
+
+	ctx := context.Background()
+	if HookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, HookTimeout)
+		defer cancel()
+	}
+
+	checksum := event.Checksum
+	if checksum == "" {
+		checksum = "-"
+	}
+
+	command := exec.CommandContext(ctx, program, event.Name, strconv.FormatInt(event.Size, 10), checksum)
+	command.Env = append(os.Environ(),
+		"TCPFT_VERB="+event.Verb,
+		"TCPFT_NAME="+event.Name,
+		"TCPFT_PATH="+event.Path,
+		"TCPFT_SIZE="+strconv.FormatInt(event.Size, 10),
+		"TCPFT_CHECKSUM="+event.Checksum,
+		"TCPFT_REMOTE="+event.Remote,
+	)
+
+	output, err := command.CombinedOutput()
+
+	firstLine, _ := bufio.NewReader(bytes.NewReader(output)).ReadString('\n')
+	return strings.TrimSpace(firstLine), err
+
+}
+
+// CommandPrePutHook wraps an executable as a pre-PUT hook. A non-zero exit
+// status rejects the upload, with the first line of output as the reason.
+func CommandPrePutHook(program string) PrePutHook {
+	return func(event HookEvent) error {
+		reason, err := runHookCommand(program, event)
+		if err == nil {
+			return nil
+		}
+		if reason == "" {
+			reason = "rejected by " + program
+		}
+		Log.Info("upload rejected by hook", "hook", program, "file", event.Name, "reason", reason, "error", err)
+		return errors.New(reason)
+	}
+}
+
+// CommandPostHook wraps an executable as a post-transfer hook. Failures are
+// logged and otherwise ignored.
+func CommandPostHook(program string) PostHook {
+	return func(event HookEvent) {
+		output, err := runHookCommand(program, event)
+		if err != nil {
+			Log.Warn("hook failed", "hook", program, "verb", event.Verb, "file", event.Name, "output", output, "error", err)
+		}
+	}
+}
+
+// stringList collects the values of a flag that may be given repeatedly.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"../common"
+)
+
+// HTTPAddr is the address of the optional HTTP gateway to the files
+// directory, with the options of -listen. It is disabled if empty.
+var (
+	HTTPAddr     string
+	HTTPListener *Listener
+)
+
+// ListingEntry is one item of an HTTP directory listing.
+type ListingEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Dir      bool      `json:"dir"`
+	Checksum string    `json:"md5,omitempty"`
+}
+
+// HTTPGateway serves the files directory at /files/ with the same path
+// confinement, hooks, logging and audit as the TCP protocol. A read-only
+// gateway refuses PUT.
+type HTTPGateway struct {
+	ReadOnly bool
+}
+
+func (gateway HTTPGateway) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+
+	conn := NewConnInfo(request.RemoteAddr)
+	ServerMetrics.ConnectionOpened()
+	defer ServerMetrics.ConnectionClosed()
+
+	name, valid := JailPath(strings.TrimPrefix(request.URL.Path, "/files/"))
+	if !valid {
+		conn.RecordRequest(request.Method, request.URL.Path, "reqerr", 0, "", time.Now())
+		http.Error(response, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	if IsReservedName(name) {
+		conn.RecordRequest(request.Method, name, "notfound", 0, "", time.Now())
+		http.NotFound(response, request)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		gateway.get(response, request, conn, name)
+	case http.MethodPut:
+		if gateway.ReadOnly {
+			conn.RecordRequest("PUT", name, "rejected", 0, "", time.Now())
+			http.Error(response, ErrReadOnly.Error(), http.StatusForbidden)
+			return
+		}
+		gateway.put(response, request, conn, name)
+	default:
+		conn.RecordRequest(request.Method, name, "reqerr", 0, "", time.Now())
+		response.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+	}
+
+}
+
+// get sends a file, with Range and conditional request support keyed on its
+// checksum, or a JSON listing if name is a directory.
+func (gateway HTTPGateway) get(response http.ResponseWriter, request *http.Request, conn *ConnInfo, name string) {
+
+	start := time.Now()
+	localFile := StorePath(name)
+
+	fileInfo, err := os.Stat(localFile)
+	if err != nil {
+		conn.RecordRequest("GET", name, "notfound", 0, "", start)
+		http.NotFound(response, request)
+		return
+	}
+
+	if fileInfo.IsDir() {
+		gateway.list(response, conn, name, localFile, start)
+		return
+	}
+
+	file, err := os.Open(localFile)
+	if err != nil {
+		conn.Log.Error("error opening file", "file", localFile, "error", err)
+		conn.RecordRequest("GET", name, "readerr", 0, "", start)
+		http.Error(response, "cannot read file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// The ETag and Last-Modified must describe the file being sent, which
+	// a commit may have replaced since the Stat above.
+	fileInfo, err = file.Stat()
+	var checksum string
+	if err == nil {
+		checksum, err = Hashes.Checksum(localFile, file, fileInfo)
+	}
+	if err != nil {
+		conn.Log.Error("error reading file", "file", localFile, "error", err)
+		conn.RecordRequest("GET", name, "readerr", 0, "", start)
+		http.Error(response, "cannot read file", http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("ETag", "\""+checksum+"\"")
+	counter := &countingWriter{ResponseWriter: response}
+	http.ServeContent(counter, request, path.Base(name), fileInfo.ModTime(), file)
+
+	conn.RecordRequest("GET", name, "ok", counter.count, checksum, start)
+	if counter.count > 0 {
+		RunPostHooks("GET", HookEvent{Verb: "GET", Name: name, Path: localFile, Size: counter.count, Checksum: checksum, Remote: conn.Remote})
+	}
+
+}
+
+// list sends the visible entries of a directory as JSON. Checksums come
+// from the hash cache only, so a listing never reads the files.
+func (gateway HTTPGateway) list(response http.ResponseWriter, conn *ConnInfo, name string, localDir string, start time.Time) {
+
+	files, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		conn.Log.Error("directory listing error", "dir", localDir, "error", err)
+		conn.RecordRequest("GET", name, "readerr", 0, "", start)
+		http.Error(response, "cannot list directory", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]ListingEntry, 0, len(files))
+	for i := 0; i < len(files); i++ {
+		if strings.HasPrefix(files[i].Name(), ".") {
+			continue
+		}
+		entry := ListingEntry{
+			Name:     files[i].Name(),
+			Size:     files[i].Size(),
+			Modified: files[i].ModTime().UTC(),
+			Dir:      files[i].IsDir(),
+		}
+		if !entry.Dir {
+			entry.Checksum, _ = Hashes.Lookup(filepath.Join(localDir, entry.Name), files[i])
+		}
+		entries = append(entries, entry)
+	}
+
+	body, _ := json.Marshal(entries)
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(body)
+
+	conn.RecordRequest("GET", name, "ok", int64(len(body)), "", start)
+
+}
+
+// put stores the request body as name. If-None-Match: * and If-Match map to
+// the create-only and match policies, and a Content-MD5 header, base64 as
+// standardised or hex like the TCP protocol's CHECKSUM, is verified.
+func (gateway HTTPGateway) put(response http.ResponseWriter, request *http.Request, conn *ConnInfo, name string) {
+
+	start := time.Now()
+
+	if name == "" || strings.HasSuffix(request.URL.Path, "/") {
+		conn.RecordRequest("PUT", name, "reqerr", 0, "", start)
+		http.Error(response, "a file name is required", http.StatusBadRequest)
+		return
+	}
+
+	condition := PutCondition{Policy: kPolicyReplace}
+	if request.Header.Get("If-None-Match") == "*" {
+		condition.Policy = kPolicyCreate
+	} else if match := request.Header.Get("If-Match"); match != "" {
+		condition = PutCondition{Policy: kPolicyMatch, Expected: strings.Trim(match, "\"")}
+	}
+
+	localFile := StorePath(name)
+
+	// The condition is settled before the body is read; CommitFile only
+	// confirms it.
+	err := CheckCondition(localFile, &condition)
+	if err == ErrExists || err == ErrConflict {
+		_, outcome := CommitResponse(name, err)
+		conn.RecordRequest("PUT", name, outcome, 0, "", start)
+		http.Error(response, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	err = RunPrePutHooks(HookEvent{Verb: "PUT", Name: name, Size: request.ContentLength, Remote: conn.Remote})
+	if err != nil {
+		conn.RecordRequest("PUT", name, "rejected", 0, "", start)
+		http.Error(response, err.(*HookRejection).Reason, http.StatusForbidden)
+		return
+	}
+
+	file, err := CreateTemp(localFile)
+	if err != nil {
+		conn.Log.Error("error creating temporary file", "file", localFile, "error", err)
+		conn.RecordRequest("PUT", name, "wrerr", 0, "", start)
+		http.Error(response, "cannot store file", http.StatusInternalServerError)
+		return
+	}
+
+	bucket := common.NewTokenBucket(ConnRate)
+	hash := md5.New()
+	count, err := io.Copy(io.MultiWriter(file, hash, limitedWriter{bucket}), request.Body)
+	if err != nil {
+		conn.Log.Info("upload interrupted", "file", name, "error", err)
+		conn.RecordRequest("PUT", name, "wrerr", count, "", start)
+		DiscardTemp(file)
+		http.Error(response, "upload interrupted", http.StatusBadRequest)
+		return
+	}
+
+	checksum := fmt.Sprintf("%x", hash.Sum(nil))
+	claimed := request.Header.Get("Content-MD5")
+	if decoded, err := base64.StdEncoding.DecodeString(claimed); err == nil && len(decoded) == md5.Size {
+		claimed = hex.EncodeToString(decoded)
+	}
+	if claimed != "" && !strings.EqualFold(claimed, checksum) {
+		conn.Log.Warn("hash mismatch", "file", name, "claimed", claimed, "received", checksum)
+		conn.RecordRequest("PUT", name, "hasherr", count, checksum, start)
+		DiscardTemp(file)
+		http.Error(response, "checksum mismatch", http.StatusBadRequest)
+		return
+	}
+
+	err = CommitFile(file, name, condition)
+
+	_, outcome := CommitResponse(name, err)
+	conn.RecordRequest("PUT", name, outcome, count, checksum, start)
+
+	if err != nil {
+		DiscardTemp(file)
+	}
+
+	switch outcome {
+	case "ok":
+		response.Header().Set("ETag", "\""+checksum+"\"")
+		response.WriteHeader(http.StatusCreated)
+		RunPostHooks("PUT", HookEvent{Verb: "PUT", Name: name, Path: localFile, Size: count, Checksum: checksum, Remote: conn.Remote})
+	case "exists", "conflict":
+		http.Error(response, err.Error(), http.StatusPreconditionFailed)
+	default:
+		conn.Log.Error("error writing file", "file", localFile, "error", err)
+		http.Error(response, "cannot store file", http.StatusInternalServerError)
+	}
+
+}
+
+// countingWriter counts the body bytes sent through it, applying the
+// per-connection and global rate limits.
+type countingWriter struct {
+	http.ResponseWriter
+	count  int64
+	bucket *common.TokenBucket
+}
+
+func (writer *countingWriter) Write(data []byte) (int, error) {
+	if writer.bucket == nil {
+		writer.bucket = common.NewTokenBucket(ConnRate)
+	}
+	common.WaitAll(len(data), writer.bucket, GlobalBucket)
+	n, err := writer.ResponseWriter.Write(data)
+	writer.count += int64(n)
+	return n, err
+}
+
+// limitedWriter discards what it is given after waiting for the rate limits.
+type limitedWriter struct {
+	bucket *common.TokenBucket
+}
+
+func (writer limitedWriter) Write(data []byte) (int, error) {
+	common.WaitAll(len(data), writer.bucket, GlobalBucket)
+	return len(data), nil
+}
+
+// ServeHTTPGateway runs the HTTP gateway on netListener, bound for
+// listener, until it fails.
+func ServeHTTPGateway(listener *Listener, netListener net.Listener) {
+
+	mux := http.NewServeMux()
+	mux.Handle("/files/", HTTPGateway{ReadOnly: listener.ReadOnly})
+
+	Log.Info("serving HTTP gateway", "address", listener.String(), "tls", listener.TLS, "readonly", listener.ReadOnly)
+	err := http.Serve(netListener, mux)
+	Log.Error("HTTP gateway stopped", "error", err)
+
+}
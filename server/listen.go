@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	Listeners []*Listener
+
+	TLSCert   string
+	TLSKey    string
+	TLSConfig *tls.Config
+)
+
+// Listener is one address the server accepts connections on. All listeners
+// share the same store; they differ only in who may connect and what they
+// may do.
+type Listener struct {
+	Network  string
+	Address  string
+	TLS      bool
+	ReadOnly bool
+
+	// Mode and Users apply to Unix sockets only.
+	Mode  os.FileMode
+	Users map[uint32]bool
+}
+
+// ParseListener reads a -listen value: an address followed by options,
+// separated by commas. The address is host:port, with the host in brackets
+// if it is IPv6, optionally prefixed by tcp4: or tcp6: to restrict the
+// family, or unix:<path>. The options are tls, readonly, mode=<octal> and
+// user=<name or id>, which may be repeated.
+func ParseListener(spec string) (*Listener, error) {
+
+	fields := strings.Split(spec, ",")
+	listener := &Listener{Network: "tcp", Address: fields[0], Mode: 0660}
+
+	for _, network := range []string{"unix", "tcp4", "tcp6", "tcp"} {
+		if strings.HasPrefix(listener.Address, network+":") {
+			listener.Network = network
+			listener.Address = strings.TrimPrefix(listener.Address, network+":")
+			break
+		}
+	}
+
+	if listener.Network != "unix" {
+		if _, _, err := net.SplitHostPort(listener.Address); err != nil {
+			return nil, err
+		}
+	} else if listener.Address == "" {
+		return nil, errors.New("missing socket path")
+	}
+
+	for _, option := range fields[1:] {
+
+		key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+
+		switch key {
+		case "tls":
+			listener.TLS = true
+		case "readonly":
+			listener.ReadOnly = true
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mode %q", value)
+			}
+			listener.Mode = os.FileMode(mode) & os.ModePerm
+		case "user":
+			users, err := ParseSocketUsers(value)
+			if err != nil {
+				return nil, err
+			}
+			if listener.Users == nil {
+				listener.Users = make(map[uint32]bool)
+			}
+			for uid := range users {
+				listener.Users[uid] = true
+			}
+		default:
+			return nil, fmt.Errorf("unknown listener option %q", option)
+		}
+
+	}
+
+	if (listener.Mode != 0660 || listener.Users != nil) && listener.Network != "unix" {
+		return nil, errors.New("mode and user only apply to unix sockets")
+	}
+
+	return listener, nil
+
+}
+
+// ParseServiceListener reads the -http or -webdav address, which takes the
+// same form and options as -listen except user=, since HTTP requests are not
+// checked against the peer's credentials. So that it is no way around the
+// policy of the protocol's listeners, it must use TLS if all of them do,
+// and be read-only if all of them are.
+func ParseServiceListener(spec string) (*Listener, error) {
+
+	listener, err := ParseListener(spec)
+	if err != nil {
+		return nil, err
+	}
+	if listener.Users != nil {
+		return nil, errors.New("user does not apply to HTTP listeners")
+	}
+
+	allTLS, allReadOnly := len(Listeners) > 0, len(Listeners) > 0
+	for i := 0; i < len(Listeners); i++ {
+		allTLS = allTLS && Listeners[i].TLS
+		allReadOnly = allReadOnly && Listeners[i].ReadOnly
+	}
+	if allTLS && !listener.TLS {
+		return nil, errors.New("every -listen address uses tls, so this one must too")
+	}
+	if allReadOnly && !listener.ReadOnly {
+		return nil, errors.New("every -listen address is readonly, so this one must be too")
+	}
+
+	return listener, nil
+
+}
+
+func (listener *Listener) String() string {
+	if listener.Network == "unix" {
+		return "unix:" + listener.Address
+	}
+	return listener.Address
+}
+
+// Listen binds the listener's address.
+func (listener *Listener) Listen() (net.Listener, error) {
+
+	if listener.TLS && TLSConfig == nil {
+		return nil, errors.New("tls requires -tls-cert and -tls-key")
+	}
+
+	if listener.Network == "unix" {
+		return listener.listenUnix()
+	}
+
+	return net.Listen(listener.Network, listener.Address)
+
+}
+
+// ListenHTTP binds the listener's address for an HTTP service, wrapping
+// its connections in TLS if the listener asks for it.
+func (listener *Listener) ListenHTTP() (net.Listener, error) {
+
+	netListener, err := listener.Listen()
+	if err != nil {
+		return nil, err
+	}
+
+	if listener.TLS {
+		return tls.NewListener(netListener, TLSConfig), nil
+	}
+	return netListener, nil
+
+}
+
+// Serve accepts connections from netListener until it fails. Peers on a
+// Unix socket are identified by their credentials and, if Users is set,
+// turned away unless they run as one of them.
+func (listener *Listener) Serve(netListener net.Listener) {
+
+	Log.Info("listening", "address", listener.String(), "tls", listener.TLS, "readonly", listener.ReadOnly)
+
+	for {
+
+		connx, err := netListener.Accept()
+		if err != nil {
+			Log.Error("error while accepting connection", "address", listener.String(), "error", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		remote := connx.RemoteAddr().String()
+
+		if unixConn, ok := connx.(*net.UnixConn); ok {
+
+			remote = "unix:" + listener.Address
+			creds, err := peerCredentials(unixConn)
+			if err == nil {
+				remote = creds.String()
+			}
+
+			if listener.Users != nil && (err != nil || !listener.Users[creds.UID]) {
+				if err == nil {
+					err = errors.New("user not allowed")
+				}
+				Log.Warn("connection refused", "remote", remote, "error", err)
+				connx.Close()
+				continue
+			}
+
+		}
+
+		if listener.TLS {
+			connx = tls.Server(connx, TLSConfig)
+		}
+
+		go ClientHandler(connx, remote, listener.ReadOnly)
+
+	}
+
+}
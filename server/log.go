@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	Log        *slog.Logger = slog.Default()
+	nextConnID int64
+)
+
+// InitLogging configures the server-wide logger. format is "logfmt" or
+// "json"; destination is "-" for stdout, "stderr", or a file path that
+// is appended to.
+func InitLogging(level string, format string, destination string) error {
+
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+
+	var output io.Writer
+	switch destination {
+	case "", "-", "stdout":
+		output = os.Stdout
+	case "stderr":
+		output = os.Stderr
+	default:
+		file, err := os.OpenFile(destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+
+	options := &slog.HandlerOptions{Level: minLevel}
+
+	switch strings.ToLower(format) {
+	case "logfmt", "text":
+		Log = slog.New(slog.NewTextHandler(output, options))
+	case "json":
+		Log = slog.New(slog.NewJSONHandler(output, options))
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	return nil
+
+}
+
+// ConnInfo identifies one client connection in the log, the metrics and
+// the audit trail.
+type ConnInfo struct {
+	ID     int64
+	Remote string
+	Log    *slog.Logger
+}
+
+// NewConnInfo assigns a fresh connection ID to the peer at remote.
+func NewConnInfo(remote string) *ConnInfo {
+	id := atomic.AddInt64(&nextConnID, 1)
+	return &ConnInfo{
+		ID:     id,
+		Remote: remote,
+		Log:    Log.With("conn", id, "remote", remote),
+	}
+}
+
+// RecordRequest logs the outcome of a single request, adds it to the server
+// metrics and appends it to the audit log. Anything other than an "ok" or
+// "notmodified" outcome is logged as a warning. checksum may be empty when no
+// body was transferred.
+func (conn *ConnInfo) RecordRequest(verb string, filename string, outcome string, bytes int64, checksum string, start time.Time) {
+
+	level := slog.LevelInfo
+	if outcome != "ok" && outcome != "notmodified" {
+		level = slog.LevelWarn
+	}
+
+	conn.Log.Log(context.Background(), level, "request",
+		"verb", verb,
+		"file", filename,
+		"bytes", bytes,
+		"duration", time.Since(start),
+		"outcome", outcome)
+
+	ServerMetrics.ObserveRequest(verb, outcome, bytes, time.Since(start))
+
+	err := Audit.Append(AuditEntry{
+		Conn:     conn.ID,
+		Remote:   conn.Remote,
+		Verb:     verb,
+		File:     filename,
+		Outcome:  outcome,
+		Bytes:    bytes,
+		Checksum: checksum,
+	})
+	if err != nil {
+		conn.Log.Error("error writing audit log", "error", err)
+	}
+
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds, in seconds, of the transfer duration histogram buckets.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+// Verbs the server knows, from any of its protocols. Others are counted as
+// "unknown", so that clients cannot create a label for every string they send.
+var metricVerbs = map[string]bool{
+	"GET": true, "PUT": true, "LINK": true, "STAT": true, "DELETE": true,
+	"UNDELETE": true, "TRASH": true, "MANIFEST": true, "VERSIONS": true,
+	"WATCH": true, "MUX": true, "FRAMING": true, "HEAD": true, "OPTIONS": true,
+	"PROPFIND": true, "MKCOL": true, "MOVE": true, "LOCK": true, "UNLOCK": true,
+}
+
+// labelEscaper escapes a label value as the text exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type requestLabels struct {
+	verb    string
+	outcome string
+}
+
+type histogram struct {
+	counts []int64
+	sum    float64
+	total  int64
+}
+
+// Metrics accumulates server-wide counters and exposes them in the
+// Prometheus text exposition format.
+type Metrics struct {
+	mutex       sync.Mutex
+	active      int64
+	connections int64
+	requests    map[requestLabels]int64
+	bytes       map[requestLabels]int64
+	durations   map[requestLabels]*histogram
+}
+
+var ServerMetrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestLabels]int64),
+		bytes:     make(map[requestLabels]int64),
+		durations: make(map[requestLabels]*histogram),
+	}
+}
+
+func (metrics *Metrics) ConnectionOpened() {
+	atomic.AddInt64(&metrics.active, 1)
+	atomic.AddInt64(&metrics.connections, 1)
+}
+
+func (metrics *Metrics) ConnectionClosed() {
+	atomic.AddInt64(&metrics.active, -1)
+}
+
+// ObserveRequest counts one finished request along with the bytes it moved
+// and how long it took.
+func (metrics *Metrics) ObserveRequest(verb string, outcome string, bytes int64, duration time.Duration) {
+
+	if !metricVerbs[verb] {
+		verb = "unknown"
+	}
+
+	labels := requestLabels{verb, outcome}
+	seconds := duration.Seconds()
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.requests[labels]++
+	metrics.bytes[labels] += bytes
+
+	hist, ok := metrics.durations[labels]
+	if !ok {
+		hist = &histogram{counts: make([]int64, len(durationBuckets))}
+		metrics.durations[labels] = hist
+	}
+
+	for i := 0; i < len(durationBuckets); i++ {
+		if seconds <= durationBuckets[i] {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += seconds
+	hist.total++
+
+}
+
+func sortedLabels(counters map[requestLabels]int64) []requestLabels {
+
+	keys := make([]requestLabels, 0, len(counters))
+	for key := range counters {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].verb != keys[j].verb {
+			return keys[i].verb < keys[j].verb
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+
+	return keys
+
+}
+
+// formatLabels formats the verb and outcome labels, followed by any others
+// given as name and value pairs.
+func formatLabels(key requestLabels, extra ...string) string {
+
+	labels := `verb="` + labelEscaper.Replace(key.verb) + `",outcome="` + labelEscaper.Replace(key.outcome) + `"`
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels += "," + extra[i] + `="` + labelEscaper.Replace(extra[i+1]) + `"`
+	}
+	return "{" + labels + "}"
+
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (metrics *Metrics) WriteTo(writer io.Writer) (int64, error) {
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	var written int64
+	printf := func(format string, args ...interface{}) {
+		n, _ := fmt.Fprintf(writer, format, args...)
+		written += int64(n)
+	}
+
+	printf("# HELP tcpft_connections_active Connections currently open.\n")
+	printf("# TYPE tcpft_connections_active gauge\n")
+	printf("tcpft_connections_active %d\n", atomic.LoadInt64(&metrics.active))
+
+	printf("# HELP tcpft_connections_total Connections accepted since startup.\n")
+	printf("# TYPE tcpft_connections_total counter\n")
+	printf("tcpft_connections_total %d\n", atomic.LoadInt64(&metrics.connections))
+
+	keys := sortedLabels(metrics.requests)
+
+	printf("# HELP tcpft_requests_total Requests handled, by verb and outcome. Checksum failures have outcome \"hasherr\".\n")
+	printf("# TYPE tcpft_requests_total counter\n")
+	for _, key := range keys {
+		printf("tcpft_requests_total%s %d\n", formatLabels(key), metrics.requests[key])
+	}
+
+	printf("# HELP tcpft_transfer_bytes_total Body bytes transferred, by verb and outcome.\n")
+	printf("# TYPE tcpft_transfer_bytes_total counter\n")
+	for _, key := range keys {
+		printf("tcpft_transfer_bytes_total%s %d\n", formatLabels(key), metrics.bytes[key])
+	}
+
+	printf("# HELP tcpft_transfer_duration_seconds Time taken to serve a request, by verb and outcome.\n")
+	printf("# TYPE tcpft_transfer_duration_seconds histogram\n")
+	for _, key := range keys {
+		hist := metrics.durations[key]
+		for i := 0; i < len(durationBuckets); i++ {
+			printf("tcpft_transfer_duration_seconds_bucket%s %d\n", formatLabels(key, "le", formatFloat(durationBuckets[i])), hist.counts[i])
+		}
+		printf("tcpft_transfer_duration_seconds_bucket%s %d\n", formatLabels(key, "le", "+Inf"), hist.total)
+		printf("tcpft_transfer_duration_seconds_sum%s %s\n", formatLabels(key), formatFloat(hist.sum))
+		printf("tcpft_transfer_duration_seconds_count%s %d\n", formatLabels(key), hist.total)
+	}
+
+	return written, nil
+
+}
+
+func (metrics *Metrics) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteTo(response)
+}
+
+// ServeMetrics runs the metrics HTTP listener until it fails.
+func ServeMetrics(address string) {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", ServerMetrics)
+
+	Log.Info("serving metrics", "address", address)
+	err := http.ListenAndServe(address, mux)
+	Log.Error("metrics listener stopped", "error", err)
+
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../common"
+)
+
+// After MUX or FRAMING BINARY, a connection carries frames instead of
+// request and response lines, each tagged with the stream it belongs to.
+// Every GET is a stream of its own; the server answers them at the same
+// time, interleaving chunks of each body, so a large file does not hold up
+// the small ones behind it.
+const (
+	// kMaxFramePayload bounds the frames a client may send.
+	kMaxFramePayload = 64 * 1024
+
+	// kMuxWindow is how much of a stream's body may be sent before the
+	// client grants more with WINDOW frames.
+	kMuxWindow = 1024 * 1024
+
+	// kMuxChunk is the largest DATA frame. Smaller chunks interleave
+	// streams more finely at the cost of more frame headers.
+	kMuxChunk = 64 * 1024
+
+	kMuxMaxStreams = 64
+)
+
+// muxStream is the flow control state of one stream: the number of bytes
+// the client is ready to receive.
+type muxStream struct {
+	id        uint32
+	mutex     sync.Mutex
+	granted   *sync.Cond
+	window    int64
+	cancelled bool
+}
+
+func newMuxStream(id uint32) *muxStream {
+	stream := &muxStream{id: id, window: kMuxWindow}
+	stream.granted = sync.NewCond(&stream.mutex)
+	return stream
+}
+
+// take waits until the stream's window is open and claims up to n bytes of
+// it. It returns 0 once the stream is cancelled.
+func (stream *muxStream) take(n int64) int64 {
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	for stream.window <= 0 && !stream.cancelled {
+		stream.granted.Wait()
+	}
+	if stream.cancelled {
+		return 0
+	}
+
+	if n > stream.window {
+		n = stream.window
+	}
+	stream.window -= n
+	return n
+
+}
+
+func (stream *muxStream) grant(n int64) {
+	stream.mutex.Lock()
+	stream.window += n
+	stream.mutex.Unlock()
+	stream.granted.Broadcast()
+}
+
+func (stream *muxStream) cancel() {
+	stream.mutex.Lock()
+	stream.cancelled = true
+	stream.mutex.Unlock()
+	stream.granted.Broadcast()
+}
+
+// muxSession serves one multiplexed connection. Frames from every stream
+// are queued on frames and written by a single goroutine; streams blocked
+// on a full queue are let through in turn, which interleaves them.
+type muxSession struct {
+	codec      common.FrameCodec
+	connInfo   *ConnInfo
+	connBucket *common.TokenBucket
+	frames     chan common.Frame
+
+	mutex   sync.Mutex
+	streams map[uint32]*muxStream
+	active  sync.WaitGroup
+}
+
+// ServeMux takes over a connection once frames have been agreed on, until
+// the client sends BYE or disconnects, either of which cancels the streams
+// still open.
+func ServeMux(reader *bufio.Reader, writer *bufio.Writer, codec common.FrameCodec, connInfo *ConnInfo, connBucket *common.TokenBucket) {
+
+	session := &muxSession{
+		codec:      codec,
+		connInfo:   connInfo,
+		connBucket: connBucket,
+		frames:     make(chan common.Frame, 16),
+		streams:    make(map[uint32]*muxStream),
+	}
+
+	written := make(chan bool)
+	go func() {
+		session.writeFrames(writer)
+		close(written)
+	}()
+
+	for {
+
+		frame, err := codec.ReadFrame(reader)
+		if err != nil {
+			connInfo.Log.Info("connection terminated", "error", err)
+			session.cancelAll()
+			break
+		}
+
+		if frame.Type == common.FrameBye {
+			session.cancelAll()
+			break
+		}
+
+		switch frame.Type {
+
+		case common.FrameRequest:
+
+			session.open(frame)
+
+		case common.FrameWindow:
+
+			increment, err := strconv.ParseInt(strings.TrimSpace(string(frame.Payload)), 10, 64)
+			if stream := session.lookup(frame.Stream); stream != nil && err == nil && increment > 0 {
+				stream.grant(increment)
+			}
+
+		case common.FrameReset:
+
+			if stream := session.lookup(frame.Stream); stream != nil {
+				stream.cancel()
+			}
+
+		}
+
+	}
+
+	session.active.Wait()
+	close(session.frames)
+	<-written
+
+}
+
+// writeFrames writes queued frames until the queue is closed, flushing
+// whenever it runs dry. If the connection fails, every stream is cancelled
+// and the rest of the queue discarded.
+func (session *muxSession) writeFrames(writer *bufio.Writer) {
+
+	var err error
+
+	for frame := range session.frames {
+
+		if err != nil {
+			continue
+		}
+
+		err = session.codec.WriteFrame(writer, frame)
+		if err == nil && len(session.frames) == 0 {
+			err = writer.Flush()
+		}
+		if err != nil {
+			session.connInfo.Log.Info("connection terminated", "error", err)
+			session.cancelAll()
+		}
+
+	}
+
+}
+
+func (session *muxSession) send(frame common.Frame) {
+	session.frames <- frame
+}
+
+func (session *muxSession) lookup(id uint32) *muxStream {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.streams[id]
+}
+
+func (session *muxSession) cancelAll() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	for _, stream := range session.streams {
+		stream.cancel()
+	}
+}
+
+// open starts a stream for a REQ frame. Only GET of a file is served; a
+// request that cannot be started is answered with a REQERR header.
+func (session *muxSession) open(frame common.Frame) {
+
+	input := strings.Split(strings.TrimSpace(string(frame.Payload)), " ")
+
+	var request GetRequest
+	valid := len(input) > 1 && strings.ToUpper(input[0]) == "GET"
+	if valid {
+		request, valid = ParseGetRequest(input)
+	}
+
+	session.mutex.Lock()
+	_, busy := session.streams[frame.Stream]
+	valid = valid && !busy && len(session.streams) < kMuxMaxStreams
+
+	if !valid {
+		session.mutex.Unlock()
+		session.connInfo.Log.Debug("request format error", "stream", frame.Stream, "input", string(frame.Payload))
+		session.connInfo.RecordRequest(strings.ToUpper(input[0]), strings.Join(input[1:], " "), "reqerr", 0, "", time.Now())
+		session.send(common.Frame{Type: common.FrameHeader, Stream: frame.Stream, Payload: []byte("REQERR\n")})
+		return
+	}
+
+	stream := newMuxStream(frame.Stream)
+	session.streams[stream.id] = stream
+	session.active.Add(1)
+	session.mutex.Unlock()
+
+	go func() {
+		session.serveGet(stream, request)
+		session.mutex.Lock()
+		delete(session.streams, stream.id)
+		session.mutex.Unlock()
+		session.active.Done()
+	}()
+
+}
+
+// respond ends a stream with a header that has no body.
+func (session *muxSession) respond(stream *muxStream, response string, filename string, outcome string, checksum string, start time.Time) {
+	session.connInfo.RecordRequest("GET", filename, outcome, 0, checksum, start)
+	session.send(common.Frame{Type: common.FrameHeader, Stream: stream.id, Payload: []byte(response + " " + filename + "\n")})
+}
+
+// serveGet answers a GET as stream: a header frame, then for OK the body in
+// DATA frames as the window allows, then an END frame with the checksum. A
+// body that cannot be completed is ended with RESET instead.
+func (session *muxSession) serveGet(stream *muxStream, request GetRequest) {
+
+	getStart := time.Now()
+	filename := request.Filename
+	connLog := session.connInfo.Log
+
+	if filename == "" || filename == "filelist.txt" {
+		session.respond(stream, "REQERR", filename, "reqerr", "", getStart)
+		return
+	}
+
+	// A copy from the proxy cache is opened straight away, so it cannot be
+	// evicted before it is sent.
+	var file *os.File
+	var err error
+	localFile := StorePath(filename)
+	if IsReservedName(filename) {
+		localFile = ""
+	} else if request.Version != "" {
+		var valid bool
+		localFile, valid = VersionPath(filename, request.Version)
+		if !valid {
+			localFile = ""
+		}
+	} else if Upstream != "" {
+
+		var upstreamChecksum string
+		file, upstreamChecksum, err = CachedFile(filename)
+		if err == nil && request.IfNoneMatch == upstreamChecksum {
+			if file != nil {
+				file.Close()
+			}
+			session.respond(stream, "NOTMODIFIED", filename, "notmodified", upstreamChecksum, getStart)
+			return
+		}
+		if err == nil && file == nil {
+			file, err = FillCache(filename)
+		}
+
+		if err == ErrNotFound {
+			session.respond(stream, "NOTFOUND", filename, "notfound", "", getStart)
+			return
+		} else if err != nil {
+			connLog.Error("error fetching file from upstream", "file", filename, "error", err)
+			session.respond(stream, "READERR", filename, "readerr", "", getStart)
+			return
+		}
+		localFile = file.Name()
+
+	}
+
+	if file == nil {
+		file, err = os.Open(localFile)
+		if err != nil {
+			connLog.Debug("error opening file", "file", localFile, "error", err)
+			session.respond(stream, "NOTFOUND", filename, "notfound", "", getStart)
+			return
+		}
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil || fileInfo.IsDir() {
+		session.respond(stream, "NOTFOUND", filename, "notfound", "", getStart)
+		return
+	}
+
+	offset, length := int64(0), fileInfo.Size()
+	var checksum string
+	if request.Ranged {
+		offset, length = request.Offset, 0
+		if offset < fileInfo.Size() {
+			length = fileInfo.Size() - offset
+		}
+		if request.Length < length {
+			length = request.Length
+		}
+		checksum, err = RangeChecksum(file, offset, length)
+	} else {
+		checksum, err = Hashes.Checksum(localFile, file, fileInfo)
+	}
+	if err != nil {
+		connLog.Error("error reading file", "file", localFile, "error", err)
+		session.respond(stream, "READERR", filename, "readerr", "", getStart)
+		return
+	}
+
+	if !RangeMatches(request, localFile, file, fileInfo) {
+		session.respond(stream, "CONFLICT", filename, "conflict", "", getStart)
+		return
+	}
+
+	if request.IfNoneMatch == checksum {
+		session.respond(stream, "NOTMODIFIED", filename, "notmodified", checksum, getStart)
+		return
+	}
+
+	session.send(common.Frame{Type: common.FrameHeader, Stream: stream.id, Payload: []byte("OK " + filename + "\n" +
+		"LENGTH " + strconv.FormatInt(length, 10) + "\n" +
+		"CHECKSUM " + checksum + "\n")})
+
+	var sent int64
+
+	for sent < length {
+
+		chunk := length - sent
+		if chunk > kMuxChunk {
+			chunk = kMuxChunk
+		}
+
+		chunk = stream.take(chunk)
+		if chunk == 0 {
+			session.connInfo.RecordRequest("GET", filename, "reset", sent, "", getStart)
+			return
+		}
+
+		data := make([]byte, chunk)
+		readBytes, err := file.ReadAt(data, offset+sent)
+		if err != nil && readBytes < len(data) {
+			if err == io.EOF {
+				err = errors.New("file was truncated")
+			}
+			connLog.Error("error sending file", "file", localFile, "error", err)
+			session.connInfo.RecordRequest("GET", filename, "readerr", sent, "", getStart)
+			session.send(common.Frame{Type: common.FrameReset, Stream: stream.id})
+			return
+		}
+
+		common.WaitAll(int(chunk), session.connBucket, GlobalBucket)
+		session.send(common.Frame{Type: common.FrameData, Stream: stream.id, Payload: data})
+		sent += chunk
+
+	}
+
+	session.send(common.Frame{Type: common.FrameEnd, Stream: stream.id, Payload: []byte("CHECKSUM " + checksum + "\n")})
+	session.connInfo.RecordRequest("GET", filename, "ok", sent, checksum, getStart)
+
+	RunPostHooks("GET", HookEvent{Verb: "GET", Name: filename, Path: localFile, Size: sent, Checksum: checksum, Remote: session.connInfo.Remote})
+
+}
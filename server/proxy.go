@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"../common"
+)
+
+var (
+	// Upstream is the address of the server this one caches, if any. A
+	// caching proxy answers GETs from Upstream and refuses changes.
+	Upstream  string
+	CacheDir  string
+	CacheSize int64
+
+	Cache *BlobCache
+)
+
+// BlobCache holds upstream file contents on disk, named by checksum, and
+// evicts the least recently used once their total size exceeds the limit.
+type BlobCache struct {
+	mutex   sync.Mutex
+	dir     string
+	limit   int64
+	used    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	checksum string
+	size     int64
+}
+
+// OpenCache indexes the blobs already in dir, most recently modified first,
+// so a restarted proxy keeps its cache.
+func OpenCache(dir string, limit int64) (*BlobCache, error) {
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &BlobCache{
+		dir:     dir,
+		limit:   limit,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	for i := 0; i < len(files); i++ {
+		if strings.HasPrefix(files[i].Name(), ".") {
+			os.Remove(filepath.Join(dir, files[i].Name()))
+			continue
+		}
+		if !files[i].Mode().IsRegular() {
+			continue
+		}
+		entry := cacheEntry{checksum: files[i].Name(), size: files[i].Size()}
+		cache.entries[entry.checksum] = cache.order.PushBack(entry)
+		cache.used += entry.size
+	}
+
+	cache.mutex.Lock()
+	cache.evict()
+	cache.mutex.Unlock()
+
+	return cache, nil
+
+}
+
+// Open opens the cached contents with checksum, marking them as recently
+// used. They are opened under the cache's lock, so they stay readable even
+// if they are evicted straight after.
+func (cache *BlobCache) Open(checksum string) (*os.File, bool) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, found := cache.entries[checksum]
+	if !found {
+		return nil, false
+	}
+
+	file, err := os.Open(filepath.Join(cache.dir, checksum))
+	if err != nil {
+		return nil, false
+	}
+
+	cache.order.MoveToFront(element)
+	return file, true
+
+}
+
+// CreateTemp opens a file to receive contents that may be added to the cache.
+func (cache *BlobCache) CreateTemp() (*os.File, error) {
+	return ioutil.TempFile(cache.dir, ".fetch-")
+}
+
+// Add moves the closed temporary file at path into the cache as checksum.
+func (cache *BlobCache) Add(path string, checksum string, size int64) error {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	err := os.Rename(path, filepath.Join(cache.dir, checksum))
+	if err != nil {
+		return err
+	}
+
+	if element, found := cache.entries[checksum]; found {
+		cache.order.MoveToFront(element)
+		return nil
+	}
+
+	cache.entries[checksum] = cache.order.PushFront(cacheEntry{checksum: checksum, size: size})
+	cache.used += size
+	cache.evict()
+
+	return nil
+
+}
+
+// evict drops least recently used blobs until the cache fits its limit.
+// Readers that already opened an evicted blob can finish with it. Callers
+// hold cache.mutex.
+func (cache *BlobCache) evict() {
+	for cache.used > cache.limit && cache.order.Len() > 0 {
+		entry := cache.order.Remove(cache.order.Back()).(cacheEntry)
+		delete(cache.entries, entry.checksum)
+		cache.used -= entry.size
+		os.Remove(filepath.Join(cache.dir, entry.checksum))
+		Log.Debug("evicted from cache", "checksum", entry.checksum, "size", entry.size)
+	}
+}
+
+// UpstreamStat asks the upstream server for the size and checksum of name.
+func UpstreamStat(name string) (int64, string, error) {
+
+	connx, err := net.Dial("tcp", Upstream)
+	if err != nil {
+		return 0, "", err
+	}
+	defer connx.Close()
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+
+	writer.WriteString("STAT " + name + "\n\n")
+	writer.Flush()
+
+	for {
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, "", err
+		}
+
+		input := strings.Fields(line)
+		if len(input) == 0 {
+			continue
+		}
+
+		writer.WriteString("BYE\n")
+		writer.Flush()
+
+		switch input[0] {
+		case "STAT":
+			if len(input) < 4 {
+				return 0, "", errors.New("invalid STAT response")
+			}
+			size, err := strconv.ParseInt(input[len(input)-2], 10, 64)
+			return size, input[len(input)-1], err
+		case "NOTFOUND":
+			return 0, "", ErrNotFound
+		}
+
+		return 0, "", fmt.Errorf("unexpected response: %s", strings.TrimSpace(line))
+
+	}
+
+}
+
+// CachedFile opens the cached copy of name if it matches what upstream
+// currently holds, or returns nil if it must be fetched, and upstream's
+// checksum. The caller closes the file.
+func CachedFile(name string) (*os.File, string, error) {
+
+	_, checksum, err := UpstreamStat(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	file, found := Cache.Open(checksum)
+	if !found {
+		return nil, checksum, nil
+	}
+	return file, checksum, nil
+
+}
+
+// FillCache fetches name from upstream into the cache without sending it
+// anywhere, for requests only a local copy can answer, such as ranges, and
+// opens the cached copy.
+func FillCache(name string) (*os.File, error) {
+
+	_, _, _, err := ProxyFetch(bufio.NewWriter(ioutil.Discard), name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	file, _, err := CachedFile(name)
+	if err == nil && file == nil {
+		err = errors.New("file was not kept in the cache")
+	}
+	return file, err
+
+}
+
+// ProxyListing relays a listing such as the index from upstream.
+func ProxyListing(writer *bufio.Writer, name string) (int64, string, error) {
+
+	connx, err := net.Dial("tcp", Upstream)
+	if err != nil {
+		return 0, "", err
+	}
+	defer connx.Close()
+
+	reader := bufio.NewReader(connx)
+	upstreamWriter := bufio.NewWriter(connx)
+
+	upstreamWriter.WriteString("GET " + name + "\n\n")
+	upstreamWriter.Flush()
+
+	var listing strings.Builder
+	_, err = readResponseBody(reader, &listing)
+	if err != nil {
+		return 0, "", err
+	}
+
+	upstreamWriter.WriteString("BYE\n")
+	upstreamWriter.Flush()
+
+	lines := make([]string, 0)
+	if body := strings.TrimSuffix(listing.String(), "\n"); body != "" {
+		lines = strings.Split(body, "\n")
+	}
+
+	totalSize, sentChecksum := WriteListing(writer, name, lines)
+	return totalSize, sentChecksum, nil
+
+}
+
+// ProxyFetch streams name from upstream to writer as a GET response while
+// saving it to the cache, which keeps it if the checksum upstream sends at
+// the end matches. That checksum is passed on, so the client sees any
+// corruption too. Once the response has started an error leaves it
+// incomplete, and started is true so the caller can drop the connection.
+func ProxyFetch(writer *bufio.Writer, name string, connBucket *common.TokenBucket) (sentBytes int64, sentChecksum string, started bool, err error) {
+
+	connx, err := net.Dial("tcp", Upstream)
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer connx.Close()
+
+	reader := bufio.NewReader(connx)
+	upstreamWriter := bufio.NewWriter(connx)
+
+	upstreamWriter.WriteString("GET " + name + "\n\n")
+	upstreamWriter.Flush()
+
+	length, advertised, err := readResponseHeader(reader)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	file, err := Cache.CreateTemp()
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	writer.WriteString("OK " + name + "\n")
+	writer.WriteString("LENGTH " + strconv.FormatInt(length, 10) + "\n")
+	if advertised != "" {
+		writer.WriteString("CHECKSUM " + advertised + "\n")
+	}
+	writer.WriteString("\n")
+
+	// The client is served to the end even if the cache cannot be written.
+	checksum := md5.New()
+	cached := &common.DrainWriter{Dest: file}
+	buffer := make([]byte, 32*1024)
+
+	for sentBytes < length {
+
+		chunk := int64(len(buffer))
+		if length-sentBytes < chunk {
+			chunk = length - sentBytes
+		}
+
+		readBytes, err := io.ReadFull(reader, buffer[:chunk])
+		if err != nil {
+			return sentBytes, "", true, err
+		}
+
+		common.WaitAll(readBytes, connBucket, GlobalBucket)
+
+		checksum.Write(buffer[:readBytes])
+		cached.Write(buffer[:readBytes])
+		writer.Write(buffer[:readBytes])
+		sentBytes += int64(readBytes)
+
+	}
+
+	sentChecksum, err = readResponseTrailer(reader)
+	if err != nil {
+		return sentBytes, "", true, err
+	}
+
+	upstreamWriter.WriteString("BYE\n")
+	upstreamWriter.Flush()
+
+	writer.WriteString("\n\nCHECKSUM " + sentChecksum + "\n\n")
+	writer.Flush()
+
+	received := fmt.Sprintf("%x", checksum.Sum(nil))
+	if received != sentChecksum {
+		return sentBytes, sentChecksum, true, fmt.Errorf("checksum mismatch: upstream sent %s, received %s", sentChecksum, received)
+	}
+
+	err = cached.Err
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = Cache.Add(file.Name(), received, sentBytes)
+	}
+	if err != nil {
+		Log.Error("error adding to cache", "file", name, "error", err)
+	}
+
+	return sentBytes, sentChecksum, true, nil
+
+}
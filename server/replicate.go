@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Primary is the address of the server this one follows, if any. A
+	// replica refuses changes from its own clients.
+	Primary        string
+	FollowInterval time.Duration
+
+	ErrReadOnly = errors.New("read-only server")
+
+	// Serialises the full sync with applying individual events.
+	replicaMutex sync.Mutex
+)
+
+// ManifestEntry describes one stored file in a MANIFEST listing.
+type ManifestEntry struct {
+	Name     string
+	Size     int64
+	Checksum string
+}
+
+// FormatManifestEntry renders an entry as a line of the MANIFEST listing.
+// The name comes last as it may contain spaces.
+func FormatManifestEntry(entry ManifestEntry) string {
+	return entry.Checksum + " " + strconv.FormatInt(entry.Size, 10) + " " + entry.Name
+}
+
+// StoredFiles returns the names of every regular file under the files
+// directory, leaving out hidden files and the areas the server manages.
+func StoredFiles() []string {
+
+	names := make([]string, 0)
+
+	filepath.Walk(kFilesDir, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != kFilesDir && strings.HasPrefix(fileInfo.Name(), ".") {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fileInfo.Mode().IsRegular() {
+			relative, _ := filepath.Rel(kFilesDir, path)
+			names = append(names, filepath.ToSlash(relative))
+		}
+		return nil
+	})
+
+	return names
+
+}
+
+// BuildManifest lists every stored file with its size and checksum.
+func BuildManifest() []ManifestEntry {
+
+	names := StoredFiles()
+	entries := make([]ManifestEntry, 0, len(names))
+
+	for i := 0; i < len(names); i++ {
+		localFile := StorePath(names[i])
+		fileInfo, err := os.Stat(localFile)
+		if err != nil {
+			continue
+		}
+		checksum, err := FileChecksum(localFile)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, ManifestEntry{Name: names[i], Size: fileInfo.Size(), Checksum: checksum})
+	}
+
+	return entries
+
+}
+
+// RejectWrites is the pre-PUT hook installed on replicas and caching proxies.
+func RejectWrites(event HookEvent) error {
+	return ErrReadOnly
+}
+
+// Follow keeps this server's files identical to those of primary, forever:
+// a full sync against the primary's manifest, then changes as the primary's
+// WATCH feed reports them. A full sync is repeated every FollowInterval to
+// catch anything the feed missed, and after the feed is interrupted.
+func Follow(primary string) {
+
+	if FollowInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(FollowInterval)
+				err := SyncFromPrimary(primary)
+				if err != nil {
+					Log.Warn("periodic sync failed", "primary", primary, "error", err)
+				}
+			}
+		}()
+	}
+
+	for {
+		err := followChanges(primary)
+		Log.Warn("replication interrupted, retrying", "primary", primary, "error", err)
+		time.Sleep(5 * time.Second)
+	}
+
+}
+
+// followChanges subscribes to the primary's changes, brings everything up to
+// date, then applies events until the connection fails. Subscribing first
+// means nothing that changes during the full sync is missed.
+func followChanges(primary string) error {
+
+	connx, err := net.Dial("tcp", primary)
+	if err != nil {
+		return err
+	}
+	defer connx.Close()
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+
+	writer.WriteString("WATCH\n")
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "WATCHING") {
+		return fmt.Errorf("primary refused WATCH: %s", strings.TrimSpace(line))
+	}
+
+	err = SyncFromPrimary(primary)
+	if err != nil {
+		return err
+	}
+
+	Log.Info("following primary", "primary", primary)
+
+	for {
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		// EVENT <kind> <name> <size> <md5>; the name may contain spaces.
+		input := strings.Split(strings.TrimRight(line, "\n"), " ")
+		if len(input) < 5 || input[0] != "EVENT" {
+			continue
+		}
+
+		name, valid := replicaName(strings.Join(input[2:len(input)-2], " "))
+		if !valid {
+			Log.Warn("ignoring change to invalid name", "primary", primary, "file", strings.Join(input[2:len(input)-2], " "))
+			continue
+		}
+
+		replicaMutex.Lock()
+		if input[1] == kEventDeleted {
+			err = DeleteFile(name)
+			if err == ErrNotFound {
+				err = nil
+			}
+		} else {
+			err = replicateFile(primary, name, input[len(input)-1])
+		}
+		replicaMutex.Unlock()
+
+		if err != nil {
+			Log.Error("error applying change", "primary", primary, "file", name, "event", input[1], "error", err)
+		}
+
+	}
+
+}
+
+// SyncFromPrimary fetches every file whose checksum differs from the
+// primary's manifest and deletes those the primary no longer has.
+func SyncFromPrimary(primary string) error {
+
+	entries, err := fetchManifest(primary)
+	if err != nil {
+		return err
+	}
+
+	replicaMutex.Lock()
+	defer replicaMutex.Unlock()
+
+	wanted := make(map[string]bool)
+	var fetched, deleted, failed int
+
+	for i := 0; i < len(entries); i++ {
+
+		name, valid := replicaName(entries[i].Name)
+		if !valid {
+			Log.Warn("ignoring invalid name in manifest", "primary", primary, "file", entries[i].Name)
+			continue
+		}
+		entries[i].Name = name
+		wanted[name] = true
+
+		current, _ := FileChecksum(StorePath(entries[i].Name))
+		if current == entries[i].Checksum {
+			continue
+		}
+
+		err = replicateFile(primary, entries[i].Name, entries[i].Checksum)
+		if err != nil {
+			Log.Error("error fetching file", "primary", primary, "file", entries[i].Name, "error", err)
+			failed++
+			continue
+		}
+		fetched++
+
+	}
+
+	names := StoredFiles()
+	for i := 0; i < len(names); i++ {
+		if !wanted[names[i]] && DeleteFile(names[i]) == nil {
+			deleted++
+		}
+	}
+
+	Log.Info("synced with primary", "primary", primary, "files", len(entries), "fetched", fetched, "deleted", deleted, "failed", failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d files failed to sync", failed)
+	}
+	return nil
+
+}
+
+// fetchManifest retrieves and parses the primary's MANIFEST listing.
+func fetchManifest(primary string) ([]ManifestEntry, error) {
+
+	connx, err := net.Dial("tcp", primary)
+	if err != nil {
+		return nil, err
+	}
+	defer connx.Close()
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+
+	writer.WriteString("MANIFEST\n\n")
+	writer.Flush()
+
+	var listing strings.Builder
+	_, err = readResponseBody(reader, &listing)
+	if err != nil {
+		return nil, err
+	}
+
+	writer.WriteString("BYE\n")
+	writer.Flush()
+
+	entries := make([]ManifestEntry, 0)
+	lines := strings.Split(listing.String(), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		fields := strings.SplitN(lines[i], " ", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, ManifestEntry{Name: fields[2], Size: size, Checksum: fields[0]})
+	}
+
+	return entries, nil
+
+}
+
+// replicaName returns the store name for a name the primary sent, and false
+// if it is one a client could not have written: outside the store, or
+// reserved.
+func replicaName(name string) (string, bool) {
+
+	name, valid := JailPath(name)
+	return name, valid && name != "" && !IsReservedName(name)
+
+}
+
+// replicateFile downloads name from primary into a temporary file and,
+// once its checksum is verified, commits it in place of the local copy.
+// Callers hold replicaMutex and have checked name with replicaName.
+func replicateFile(primary string, name string, expected string) error {
+
+	current, _ := FileChecksum(StorePath(name))
+	if current == expected {
+		return nil
+	}
+
+	connx, err := net.Dial("tcp", primary)
+	if err != nil {
+		return err
+	}
+	defer connx.Close()
+
+	reader := bufio.NewReader(connx)
+	writer := bufio.NewWriter(connx)
+
+	writer.WriteString("GET " + name + "\n\n")
+	writer.Flush()
+
+	file, err := CreateTemp(StorePath(name))
+	if err != nil {
+		return err
+	}
+
+	_, err = readResponseBody(reader, file)
+	if err != nil {
+		DiscardTemp(file)
+		return err
+	}
+
+	writer.WriteString("BYE\n")
+	writer.Flush()
+
+	err = CommitFile(file, name, PutCondition{Policy: kPolicyReplace})
+	if err != nil {
+		DiscardTemp(file)
+		return err
+	}
+
+	return nil
+
+}
+
+// readResponseBody parses one "OK" response, copying its body to dest, and
+// returns the body's checksum after checking it against the one the server
+// sent.
+func readResponseBody(reader *bufio.Reader, dest io.Writer) (string, error) {
+
+	length, _, err := readResponseHeader(reader)
+	if err != nil {
+		return "", err
+	}
+
+	checksum := md5.New()
+	_, err = io.CopyN(io.MultiWriter(dest, checksum), reader, length)
+	if err != nil {
+		return "", err
+	}
+	received := fmt.Sprintf("%x", checksum.Sum(nil))
+
+	sent, err := readResponseTrailer(reader)
+	if err != nil {
+		return "", err
+	}
+
+	if sent != received {
+		return "", fmt.Errorf("checksum mismatch: sent %s, received %s", sent, received)
+	}
+	return received, nil
+
+}
+
+// readResponseHeader reads another server's response up to the start of the
+// body and returns the body length and the checksum sent ahead of it, which
+// servers before the hash cache do not send. NOTFOUND is returned as
+// ErrNotFound. Header lines it does not know, which newer servers may add,
+// are skipped, but the response itself must be OK.
+func readResponseHeader(reader *bufio.Reader) (int64, string, error) {
+
+	var length int64 = -1
+	var checksum string
+	started := false
+
+	for {
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, "", err
+		}
+
+		input := strings.Split(strings.TrimRight(line, "\n"), " ")
+
+		switch {
+		case input[0] == "":
+			if length >= 0 {
+				return length, checksum, nil
+			}
+			continue
+		case !started && input[0] == "NOTFOUND":
+			return 0, "", ErrNotFound
+		case !started && input[0] != "OK":
+			return 0, "", fmt.Errorf("unexpected response: %s", strings.TrimSpace(line))
+		}
+		started = true
+
+		switch input[0] {
+		case "CHECKSUM":
+			if len(input) > 1 {
+				checksum = input[1]
+			}
+		case "LENGTH":
+			if len(input) < 2 {
+				return 0, "", errors.New("invalid LENGTH header")
+			}
+			length, err = strconv.ParseInt(input[1], 10, 64)
+			if err != nil {
+				return 0, "", err
+			}
+		}
+
+	}
+
+}
+
+// readResponseTrailer reads what follows a body and returns the checksum the
+// server sent.
+func readResponseTrailer(reader *bufio.Reader) (string, error) {
+
+	for {
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		input := strings.Fields(line)
+		if len(input) >= 2 && input[0] == "CHECKSUM" {
+			return input[1], nil
+		}
+
+	}
+
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadResponseHeader(t *testing.T) {
+
+	cases := []struct {
+		response string
+		length   int64
+		checksum string
+		err      string
+	}{
+		{"OK a\nLENGTH 5\nCHECKSUM abc\n\n", 5, "abc", ""},
+		{"OK a\nLENGTH 5\n\n", 5, "", ""},
+		{"\nOK a\nMODIFIED 2026-01-01T00:00:00Z\nLENGTH 3\nX-NEW header\n\n", 3, "", ""},
+		{"NOTFOUND a\n\n", 0, "", ErrNotFound.Error()},
+		{"READERR a\n\n", 0, "", "unexpected response: READERR a"},
+		{"OK a\nLENGTH x\n\n", 0, "", "invalid syntax"},
+	}
+
+	for _, c := range cases {
+		length, checksum, err := readResponseHeader(bufio.NewReader(strings.NewReader(c.response)))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: got error %v, want %q", c.response, err, c.err)
+			}
+			continue
+		}
+		if err != nil || length != c.length || checksum != c.checksum {
+			t.Errorf("%q: got %d, %q, %v, want %d, %q", c.response, length, checksum, err, c.length, c.checksum)
+		}
+	}
+
+}
+
+func TestReplicaName(t *testing.T) {
+
+	cases := []struct {
+		name  string
+		want  string
+		valid bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"d/./e.txt", "d/e.txt", true},
+		{"../x", "", false},
+		{"d/../../x", "", false},
+		{"..\\x", "", false},
+		{"/etc/passwd", "", false},
+		{"", "", false},
+		{".trash/a", "", false},
+	}
+
+	for _, c := range cases {
+		name, valid := replicaName(c.name)
+		if valid != c.valid || (valid && name != c.want) {
+			t.Errorf("%q: got %q, %v, want %q, %v", c.name, name, valid, c.want, c.valid)
+		}
+	}
+
+}
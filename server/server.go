@@ -3,13 +3,21 @@ package main
 import (
 	"bufio"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"../common"
 )
 
 const (
@@ -22,26 +30,426 @@ const (
 )
 
 var (
-	Port string
+	Port         string
+	ConnRate     int64
+	GlobalBucket *common.TokenBucket
+	LogLevel     string
+	LogFormat    string
+	LogFile      string
+	MetricsAddr  string
+	AuditFile    string
 )
 
 func InitFlags() {
-	flag.StringVar(&Port, "port", "65500", "Port number to listen on.")
+
+	var connRate, globalRate string
+
+	flag.StringVar(&Port, "port", "65500", "Port number to listen on, on all addresses, if no -listen is given.")
+	flag.StringVar(&connRate, "limit-rate", "0", "Maximum transfer rate per connection in bytes per second, e.g. 512k or 10M. 0 is unlimited.")
+	flag.StringVar(&globalRate, "global-limit-rate", "0", "Maximum transfer rate across all connections in bytes per second. 0 is unlimited.")
+	flag.StringVar(&LogLevel, "log-level", "info", "Minimum log level: debug, info, warn or error.")
+	flag.StringVar(&LogFormat, "log-format", "logfmt", "Log output format: logfmt or json.")
+	flag.StringVar(&LogFile, "log-file", "-", "Log destination: - for stdout, stderr, or a file path to append to.")
+	flag.StringVar(&MetricsAddr, "metrics", "", "Address for the HTTP metrics listener, e.g. :9100. Disabled if empty.")
+	flag.StringVar(&AuditFile, "audit-log", "", "Append a hash-chained audit record of every request to this file. Disabled if empty.")
+	flag.StringVar(&StoreBackend, "store", "plain", "Storage backend: plain, or cas to store identical contents once and let clients skip uploading them.")
+	flag.IntVar(&KeepVersions, "keep-versions", 0, "Number of prior versions of each file to keep when it is overwritten. 0 keeps none unless version-age is set.")
+	flag.DurationVar(&VersionAge, "version-age", 0, "Discard prior versions older than this, e.g. 720h. 0 keeps them regardless of age.")
+	flag.DurationVar(&TrashRetention, "trash-retention", 0, "Keep deleted and overwritten files recoverable for this long, e.g. 168h. 0 deletes permanently.")
+	var prePutHooksFlag, postPutHooksFlag, postGetHooksFlag stringList
+	flag.Var(&prePutHooksFlag, "pre-put-hook", "Executable run with <name> <size> - before an upload's body is received, so without its checksum (LINK passes <md5>); a non-zero exit rejects it. May be repeated.")
+	flag.Var(&postPutHooksFlag, "post-put-hook", "Executable run with <name> <size> <md5> after an upload is stored. May be repeated.")
+	flag.Var(&postGetHooksFlag, "post-get-hook", "Executable run with <name> <size> <md5> after a file is sent. May be repeated.")
+	flag.DurationVar(&HookTimeout, "hook-timeout", 30*time.Second, "Maximum run time of each hook executable. 0 is unlimited.")
+	flag.StringVar(&Primary, "follow", "", "Run as a read-only replica of the server at this host:port, mirroring its files.")
+	flag.DurationVar(&FollowInterval, "follow-interval", 10*time.Minute, "How often a replica re-checks every file against the primary, in case a change was missed. 0 disables.")
+	flag.StringVar(&Upstream, "upstream", "", "Run as a read-through caching proxy for the server at this host:port.")
+	flag.StringVar(&CacheDir, "cache-dir", "cache", "Where a caching proxy keeps file contents.")
+	cacheSize := flag.String("cache-size", "1G", "Maximum size of a caching proxy's cache, e.g. 500M or 20G. Least recently used files are evicted first.")
+	flag.StringVar(&HTTPAddr, "http", "", "Address for the HTTP gateway to the files directory, e.g. :8080, with the options of -listen other than user. Disabled if empty.")
+	flag.StringVar(&WebDAVAddr, "webdav", "", "Address for the WebDAV listener presenting the files directory as a network drive, e.g. :8081, with the options of -listen other than user. Disabled if empty.")
+	var listenFlag stringList
+	flag.Var(&listenFlag, "listen", "Address to accept connections on instead of -port: host:port, [ipv6]:port, tcp4:/tcp6: prefixed, or unix:<path>, followed by comma-separated options tls, readonly, and for sockets mode=<octal> and user=<name or id>. May be repeated.")
+	flag.StringVar(&TLSCert, "tls-cert", "", "PEM certificate file for listeners with the tls option.")
+	flag.StringVar(&TLSKey, "tls-key", "", "PEM private key file for listeners with the tls option.")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM file of certificate authorities that sign client certificates. If given, clients of tls listeners must present a certificate signed by one of them.")
+	flag.StringVar(&HashCachePath, "hash-cache", "files/.hashes", "File in which checksums of stored files are kept between runs, so unchanged files are not hashed again. Only kept in memory if empty.")
+	flag.StringVar(&SocketPath, "socket", "", "Also listen on a Unix socket at this path, for clients on the same host. Disabled if empty.")
+	socketMode := flag.String("socket-mode", "0660", "Permissions of the Unix socket, in octal. Only users who may write to it can connect.")
+	socketUsers := flag.String("socket-users", "", "Comma-separated user names or IDs allowed to connect over the Unix socket, checked with SO_PEERCRED. Empty allows any user the permissions do.")
+	bufferSize := flag.String("buffer-size", "256k", "Size of the buffer bodies are copied through, e.g. 64k or 1M.")
+	verifyAudit := flag.String("verify-audit", "", "Verify the hash chain of the given audit log and exit.")
 	flag.Parse()
+
+	if *verifyAudit != "" {
+		entries, lastHash, error := VerifyAuditLog(*verifyAudit)
+		if error != nil {
+			fmt.Println("Audit log verification failed:", error)
+			os.Exit(1)
+		}
+		fmt.Println("Audit log intact:", entries, "entries, head", lastHash)
+		os.Exit(0)
+	}
+
+	error := InitLogging(LogLevel, LogFormat, LogFile)
+	if error != nil {
+		fmt.Println("Error configuring logging:", error)
+		os.Exit(1)
+	}
+
+	for i := 0; i < len(prePutHooksFlag); i++ {
+		RegisterPrePutHook(CommandPrePutHook(prePutHooksFlag[i]))
+	}
+	for i := 0; i < len(postPutHooksFlag); i++ {
+		RegisterPostPutHook(CommandPostHook(postPutHooksFlag[i]))
+	}
+	for i := 0; i < len(postGetHooksFlag); i++ {
+		RegisterPostGetHook(CommandPostHook(postGetHooksFlag[i]))
+	}
+
+	if StoreBackend != "plain" && StoreBackend != "cas" {
+		fmt.Println("Unknown storage backend:", StoreBackend)
+		os.Exit(1)
+	}
+
+	rate, error := common.ParseRate(connRate)
+	if error != nil {
+		fmt.Println("Error parsing limit-rate:", error)
+		os.Exit(1)
+	}
+	ConnRate = rate
+
+	rate, error = common.ParseRate(globalRate)
+	if error != nil {
+		fmt.Println("Error parsing global-limit-rate:", error)
+		os.Exit(1)
+	}
+	GlobalBucket = common.NewTokenBucket(rate)
+
+	size, error := common.ParseRate(*bufferSize)
+	if error != nil || size < 4096 || size > 64<<20 {
+		fmt.Println("Error parsing buffer-size: must be between 4k and 64M")
+		os.Exit(1)
+	}
+	common.BufferSize = int(size)
+
+	mode, error := strconv.ParseUint(*socketMode, 8, 32)
+	if error != nil {
+		fmt.Println("Error parsing socket-mode:", error)
+		os.Exit(1)
+	}
+	SocketMode = os.FileMode(mode) & os.ModePerm
+
+	if *socketUsers != "" {
+		SocketUsers, error = ParseSocketUsers(*socketUsers)
+		if error != nil {
+			fmt.Println("Error parsing socket-users:", error)
+			os.Exit(1)
+		}
+	}
+
+	if TLSCert != "" || TLSKey != "" {
+		certificate, error := tls.LoadX509KeyPair(TLSCert, TLSKey)
+		if error != nil {
+			fmt.Println("Error loading TLS certificate:", error)
+			os.Exit(1)
+		}
+		TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+
+	if *tlsClientCA != "" {
+		if TLSConfig == nil {
+			fmt.Println("tls-client-ca requires -tls-cert and -tls-key")
+			os.Exit(1)
+		}
+		pem, error := ioutil.ReadFile(*tlsClientCA)
+		if error != nil {
+			fmt.Println("Error reading tls-client-ca:", error)
+			os.Exit(1)
+		}
+		TLSConfig.ClientCAs = x509.NewCertPool()
+		if !TLSConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			fmt.Println("No certificates found in", *tlsClientCA)
+			os.Exit(1)
+		}
+		TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if len(listenFlag) == 0 {
+		listenFlag = append(listenFlag, ":"+Port)
+	}
+	for i := 0; i < len(listenFlag); i++ {
+		listener, error := ParseListener(listenFlag[i])
+		if error != nil {
+			fmt.Println("Error parsing listen address", listenFlag[i]+":", error)
+			os.Exit(1)
+		}
+		Listeners = append(Listeners, listener)
+	}
+	if SocketPath != "" {
+		Listeners = append(Listeners, &Listener{Network: "unix", Address: SocketPath, Mode: SocketMode, Users: SocketUsers})
+	}
+
+	if HTTPAddr != "" {
+		HTTPListener, error = ParseServiceListener(HTTPAddr)
+		if error != nil {
+			fmt.Println("Error parsing http address", HTTPAddr+":", error)
+			os.Exit(1)
+		}
+	}
+	if WebDAVAddr != "" {
+		WebDAVListener, error = ParseServiceListener(WebDAVAddr)
+		if error != nil {
+			fmt.Println("Error parsing webdav address", WebDAVAddr+":", error)
+			os.Exit(1)
+		}
+	}
+
+	if Upstream != "" {
+		size, error := common.ParseRate(*cacheSize)
+		if error != nil {
+			fmt.Println("Error parsing cache-size:", error)
+			os.Exit(1)
+		}
+		Cache, error = OpenCache(CacheDir, size)
+		if error != nil {
+			fmt.Println("Error opening cache:", error)
+			os.Exit(1)
+		}
+	}
+
+	if AuditFile != "" {
+		Audit, error = OpenAuditLog(AuditFile)
+		if error != nil {
+			fmt.Println("Error opening audit log:", error)
+			os.Exit(1)
+		}
+	}
+
+}
+
+// GetRequest is one entry of a batch of GET-style requests, answered in
+// order once the client ends the batch with a blank line.
+type GetRequest struct {
+	Filename     string
+	Version      string
+	ListVersions bool
+	ListTrash    bool
+	ListManifest bool
+	Ranged       bool
+	Offset       int64
+	Length       int64
+	IfMatch      string
+	IfNoneMatch  string
+}
+
+// ParseGetRequest reads a "GET <fname> [VERSION <id> | RANGE <offset>
+// <length> [IF-MATCH <md5>] | IF-NONE-MATCH <md5>]" request line, split on
+// spaces. Options that do not parse are ignored. It returns false if the
+// name is not valid.
+func ParseGetRequest(input []string) (GetRequest, bool) {
+
+	filename, valid := JailPath(input[1])
+	request := GetRequest{Filename: filename}
+
+	if len(input) > 3 && strings.ToUpper(input[2]) == "VERSION" {
+		request.Version = input[3]
+	}
+
+	if len(input) > 4 && strings.ToUpper(input[2]) == "RANGE" {
+		offset, offsetError := strconv.ParseInt(input[3], 10, 64)
+		length, lengthError := strconv.ParseInt(input[4], 10, 64)
+		if offsetError == nil && lengthError == nil && offset >= 0 && length >= 0 {
+			request.Ranged, request.Offset, request.Length = true, offset, length
+		}
+	}
+
+	if len(input) > 6 && request.Ranged && strings.ToUpper(input[5]) == "IF-MATCH" {
+		request.IfMatch = strings.ToLower(input[6])
+	}
+
+	if len(input) > 3 && strings.ToUpper(input[2]) == "IF-NONE-MATCH" {
+		request.IfNoneMatch = strings.ToLower(input[3])
+	}
+
+	return request, valid
+
+}
+
+// JailPath confines a client-supplied name to the files directory. The name
+// is cleaned, and rejected if it is absolute or has a ".." component rather
+// than being rewritten. The files directory itself is the empty name.
+func JailPath(filename string) (string, bool) {
+
+	if filename == "" {
+		return "", true
+	}
+
+	if path.IsAbs(filename) || filepath.IsAbs(filename) || filepath.VolumeName(filename) != "" {
+		return "", false
+	}
+
+	components := strings.FieldsFunc(filename, func(r rune) bool { return r == '/' || r == '\\' })
+	for i := 0; i < len(components); i++ {
+		if components[i] == ".." {
+			return "", false
+		}
+	}
+
+	filename = path.Clean(filepath.ToSlash(filename))
+	if filename == "." {
+		return "", true
+	}
+
+	return filename, true
+
+}
+
+// requestName returns the file named by a request line, and false if it
+// names none or one clients may not change.
+func requestName(input []string) (string, bool) {
+
+	if len(input) < 2 {
+		return "", false
+	}
+
+	name, valid := JailPath(input[1])
+	return name, valid && name != "" && !IsReservedName(name)
+
+}
+
+// WriteListing sends lines as the body of an "OK <name>" response, one per
+// line, and returns the body length and checksum.
+func WriteListing(writer *bufio.Writer, name string, lines []string) (int64, string) {
+
+	var totalSize int64 = 0
+	for i := 0; i < len(lines); i++ {
+		totalSize += int64(len(lines[i]) + 1)
+	}
+
+	checksum := md5.New()
+	for i := 0; i < len(lines); i++ {
+		checksum.Write([]byte(lines[i] + "\n"))
+	}
+	sentChecksum := fmt.Sprintf("%x", checksum.Sum(make([]byte, 0)))
+
+	writer.WriteString("OK " + name + "\n")
+	writer.WriteString("LENGTH " + strconv.FormatInt(totalSize, 10) + "\n")
+	writer.WriteString("CHECKSUM " + sentChecksum + "\n\n")
+
+	for i := 0; i < len(lines); i++ {
+		writer.WriteString(lines[i] + "\n")
+	}
+
+	writer.WriteString("\nCHECKSUM " + sentChecksum + "\n\n")
+	writer.Flush()
+
+	return totalSize, sentChecksum
+
+}
+
+// kSendChunk is how much of a file is sent between rate limit checks.
+const kSendChunk = 64 * 1024
+
+// SendBody sends length bytes of file from offset, after whatever is
+// buffered in writer. On a plain TCP connection the file is copied to the
+// socket directly, which Linux does with sendfile(2); other connections,
+// such as TLS, are written through a body buffer. Without rate limits the
+// whole range is one copy.
+func SendBody(connx net.Conn, writer *bufio.Writer, file *os.File, offset int64, length int64, connBucket *common.TokenBucket) (int64, error) {
+
+	err := writer.Flush()
+	if err != nil {
+		return 0, err
+	}
+	tcpConn, direct := connx.(*net.TCPConn)
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	var sentBytes int64
+	for sentBytes < length {
+
+		chunk := length - sentBytes
+		if (connBucket != nil || GlobalBucket != nil) && chunk > kSendChunk {
+			chunk = kSendChunk
+		}
+		common.WaitAll(int(chunk), connBucket, GlobalBucket)
+
+		var copied int64
+		if direct {
+			copied, err = io.CopyN(tcpConn, file, chunk)
+		} else {
+			copied, err = common.CopyBody(connx, file, chunk)
+		}
+		sentBytes += copied
+		if err == nil && copied < chunk {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return sentBytes, err
+		}
+
+	}
+
+	return sentBytes, nil
+
+}
+
+// CommitResponse maps the result of storing the file called name to the
+// response line sent to the client and the outcome recorded for the
+// request.
+func CommitResponse(name string, err error) (string, string) {
+
+	if rejection, ok := err.(*HookRejection); ok {
+		return "REJECTED " + name + " " + strings.Join(strings.Fields(rejection.Reason), " "), "rejected"
+	}
+
+	switch err {
+	case nil:
+		return "RECV " + name, "ok"
+	case ErrExists:
+		return "EXISTS " + name, "exists"
+	case ErrConflict:
+		return "CONFLICT " + name, "conflict"
+	case ErrNoBlob:
+		return "NOTFOUND " + name, "notfound"
+	}
+
+	return "WRERR " + name, "wrerr"
+
 }
 
-func ClientHandler(connx *net.TCPConn) {
+// ClientHandler serves one connection. On a read-only listener changes are
+// rejected as they are on a replica.
+func ClientHandler(connx net.Conn, remote string, readOnly bool) {
 
 	var filenames []string
+	var getQueue []GetRequest
 	var state int = kStateSetup
 	var leanState int = kStateConfig
 	var rxLength int64
+	var putStart time.Time
+	var putCondition PutCondition
+	var putRefusal error
+	var putVerb string
+	var putChecksum string
+	var putDigest string
 
 	temp := make([]string, 0)
 
 	reader := bufio.NewReader(connx)
 	writer := bufio.NewWriter(connx)
-
+	connBucket := common.NewTokenBucket(ConnRate)
+	firstLine := true
+	connInfo := NewConnInfo(remote)
+	connLog := connInfo.Log
+
+	connLog.Debug("connection accepted")
+	ServerMetrics.ConnectionOpened()
+	defer ServerMetrics.ConnectionClosed()
 	defer connx.Close()
 
 	for {
@@ -49,14 +457,15 @@ func ClientHandler(connx *net.TCPConn) {
 
 		case kStateSetup:
 
-			filenames = append(make([]string, 0))
+			filenames = make([]string, 0)
+			getQueue = make([]GetRequest, 0)
 			state = kStateConfig
 
 		case kStateConfig:
 
 			line, prefix, error := reader.ReadLine()
 			if error != nil {
-				fmt.Println("[", connx.RemoteAddr(), "] Connection terminated:", error)
+				connLog.Info("connection terminated", "error", error)
 				return
 			}
 			temp = append(temp, string(line))
@@ -68,6 +477,9 @@ func ClientHandler(connx *net.TCPConn) {
 			input := strings.Split(toParse, " ")
 			temp = make([]string, 0)
 
+			negotiable := firstLine
+			firstLine = false
+
 			switch strings.ToUpper(input[0]) {
 
 			case "BYE":
@@ -78,11 +490,14 @@ func ClientHandler(connx *net.TCPConn) {
 
 				state = leanState
 
-			case "GET":
+			case "TRASH", "MANIFEST":
+
+				verb := strings.ToUpper(input[0])
 
-				if leanState == kStatePutMode || len(input) < 2 {
+				if leanState == kStatePutMode {
 
-					fmt.Println("[", connx.RemoteAddr(), "] Request Format Error:", input)
+					connLog.Debug("request format error", "input", toParse)
+					connInfo.RecordRequest(verb, "", "reqerr", 0, "", time.Now())
 					writer.WriteString("REQERR\n")
 					writer.Flush()
 
@@ -92,41 +507,129 @@ func ClientHandler(connx *net.TCPConn) {
 
 				}
 
-				filename := input[1]
+				getQueue = append(getQueue, GetRequest{ListTrash: verb == "TRASH", ListManifest: verb == "MANIFEST"})
+				leanState = kStateGetMode
 
-				// Pseudo-chroot jail
-				touched := true
-				for touched {
+			case "WATCH":
 
-					touched = false
+				// WATCH takes over the connection: events are streamed
+				// until the client sends BYE or disconnects.
+				watchPath, valid := JailPath(strings.Join(input[1:], " "))
 
-					if len(filename) > 1 && filename[:1] == "/" {
-						filename = filename[1:]
-						touched = true
-					}
+				if leanState != kStateConfig || !valid {
 
-					if len(filename) > 2 && filename[:2] == "./" {
-						filename = filename[2:]
-						touched = true
-					}
+					connLog.Debug("request format error", "input", toParse)
+					connInfo.RecordRequest("WATCH", strings.Join(input[1:], " "), "reqerr", 0, "", time.Now())
+					writer.WriteString("REQERR\n")
+					writer.Flush()
+
+					state = kStateSetup
+					leanState = kStateConfig
+					continue
 
-					if len(filename) > 3 && filename[:3] == "../" {
-						filename = filename[3:]
-						touched = true
+				}
+
+				watchStart := time.Now()
+				feed := StartChangeFeed()
+				events := feed.Subscribe()
+
+				writer.WriteString("WATCHING " + watchPath + "\n")
+				writer.Flush()
+
+				done := make(chan bool)
+				go func() {
+					for {
+						line, _, error := reader.ReadLine()
+						if error != nil || strings.ToUpper(strings.TrimSpace(string(line))) == "BYE" {
+							close(done)
+							return
+						}
 					}
+				}()
+
+				var sentEvents int64
+				watching := true
+
+				for watching {
+					select {
+					case event, open := <-events:
+						if !open {
+							watching = false
+						} else if WatchMatches(watchPath, event.Name) {
+							writer.WriteString(event.Line() + "\n")
+							watching = writer.Flush() == nil
+							sentEvents++
+						}
+					case <-done:
+						watching = false
+					}
+				}
+
+				feed.Unsubscribe(events)
+				connInfo.RecordRequest("WATCH", watchPath, "ok", sentEvents, "", watchStart)
+				return
+
+			case "MUX":
 
+				// MUX takes over the connection: requests and responses are
+				// framed and interleaved until the client sends BYE.
+				if leanState != kStateConfig {
+
+					connLog.Debug("request format error", "input", toParse)
+					connInfo.RecordRequest("MUX", "", "reqerr", 0, "", time.Now())
+					writer.WriteString("REQERR\n")
+					writer.Flush()
+
+					state = kStateSetup
+					leanState = kStateConfig
+					continue
+
+				}
+
+				writer.WriteString("MUXING " + strconv.Itoa(kMuxWindow) + "\n")
+				if writer.Flush() == nil {
+					ServeMux(reader, writer, common.TextFrames{MaxPayload: kMaxFramePayload}, connInfo, connBucket)
 				}
+				return
 
-				filename = strings.Replace(filename, "../", "", -1)
+			case "FRAMING":
 
-				filenames = append(filenames, filename)
-				leanState = kStateGetMode
+				// The wire format can only be chosen before anything else is
+				// sent. The reply names the format the server will use, which
+				// is text if the one asked for is not known.
+				if !negotiable {
+
+					connLog.Debug("request format error", "input", toParse)
+					connInfo.RecordRequest("FRAMING", strings.Join(input[1:], " "), "reqerr", 0, "", time.Now())
+					writer.WriteString("REQERR\n")
+					writer.Flush()
+
+					state = kStateSetup
+					leanState = kStateConfig
+					continue
+
+				}
+
+				if len(input) < 2 || strings.ToUpper(input[1]) != "BINARY" {
+					writer.WriteString("FRAMING TEXT\n")
+					writer.Flush()
+					continue
+				}
+
+				writer.WriteString("FRAMING BINARY " + strconv.Itoa(kMuxWindow) + "\n")
+				if writer.Flush() == nil {
+					ServeMux(reader, writer, common.BinaryFrames{MaxPayload: kMaxFramePayload}, connInfo, connBucket)
+				}
+				return
+
+			case "STAT":
 
-			case "PUT":
+				filename, valid := requestName(input)
 
-				if leanState == kStateGetMode || len(input) < 2 {
+				if leanState != kStateConfig || !valid {
 
-					fmt.Println("[", connx.RemoteAddr(), "] Request Format Error:", input)
+					connLog.Debug("request format error", "input", toParse)
+					connInfo.RecordRequest("STAT", strings.Join(input[1:], " "), "reqerr", 0, "", time.Now())
 					writer.WriteString("REQERR\n")
 					writer.Flush()
 
@@ -136,40 +639,151 @@ func ClientHandler(connx *net.TCPConn) {
 
 				}
 
-				filename := input[1]
+				requestStart := time.Now()
 
-				// Pseudo-chroot jail
-				touched := true
-				for touched {
+				statFile := StatFile
+				if Upstream != "" {
+					statFile = UpstreamStat
+				}
+				size, statChecksum, statError := statFile(filename)
+
+				if statError == ErrNotFound {
+					connInfo.RecordRequest("STAT", filename, "notfound", 0, "", requestStart)
+					writer.WriteString("NOTFOUND " + filename + "\n\n")
+				} else if statError != nil {
+					connLog.Error("error checking file", "file", filename, "error", statError)
+					connInfo.RecordRequest("STAT", filename, "readerr", 0, "", requestStart)
+					writer.WriteString("READERR " + filename + "\n\n")
+				} else {
+					connInfo.RecordRequest("STAT", filename, "ok", 0, statChecksum, requestStart)
+					writer.WriteString("STAT " + filename + " " + strconv.FormatInt(size, 10) + " " + statChecksum + "\n\n")
+				}
+				writer.Flush()
 
-					touched = false
+			case "DELETE", "UNDELETE":
 
-					if len(filename) > 1 && filename[:1] == "/" {
-						filename = filename[1:]
-						touched = true
-					}
+				// These act immediately, so they may not be mixed into a
+				// batch whose responses are still pending.
+				verb := strings.ToUpper(input[0])
+				filename, valid := requestName(input)
 
-					if len(filename) > 2 && filename[:2] == "./" {
-						filename = filename[2:]
-						touched = true
-					}
+				if leanState != kStateConfig || !valid {
+
+					connLog.Debug("request format error", "input", toParse)
+					connInfo.RecordRequest(verb, strings.Join(input[1:], " "), "reqerr", 0, "", time.Now())
+					writer.WriteString("REQERR\n")
+					writer.Flush()
+
+					state = kStateSetup
+					leanState = kStateConfig
+					continue
+
+				}
 
-					if len(filename) > 3 && filename[:3] == "../" {
-						filename = filename[3:]
-						touched = true
+				requestStart := time.Now()
+
+				response := "DELETED"
+				changeError := ErrNotFound
+				if Primary != "" || Upstream != "" || readOnly {
+					changeError = ErrReadOnly
+				} else if verb == "DELETE" {
+					changeError = DeleteFile(filename)
+				} else {
+					id := ""
+					if len(input) > 2 {
+						id = input[2]
 					}
+					changeError = Undelete(filename, id)
+					response = "RESTORED"
+				}
+
+				outcome := "ok"
+				reason := ""
+				if changeError == ErrNotFound {
+					response, outcome = "NOTFOUND", "notfound"
+				} else if changeError == ErrReadOnly {
+					response, outcome = "REJECTED", "rejected"
+					reason = " " + ErrReadOnly.Error()
+				} else if changeError != nil {
+					connLog.Error("error changing file", "verb", verb, "file", filename, "error", changeError)
+					response, outcome = "WRERR", "wrerr"
+				}
+
+				connInfo.RecordRequest(verb, filename, outcome, 0, "", requestStart)
+				writer.WriteString(response + " " + filename + reason + "\n\n")
+				writer.Flush()
+
+			case "GET", "VERSIONS":
+
+				verb := strings.ToUpper(input[0])
+
+				var request GetRequest
+				valid := len(input) > 1
+				if valid && verb == "GET" {
+					request, valid = ParseGetRequest(input)
+				} else if valid {
+					request.Filename, valid = requestName(input)
+					request.ListVersions = true
+				}
+
+				if leanState == kStatePutMode || !valid {
+
+					connLog.Debug("request format error", "input", toParse)
+					connInfo.RecordRequest(verb, strings.Join(input[1:], " "), "reqerr", 0, "", time.Now())
+					writer.WriteString("REQERR\n")
+					writer.Flush()
+
+					state = kStateSetup
+					leanState = kStateConfig
+					continue
+
+				}
+
+				getQueue = append(getQueue, request)
+				leanState = kStateGetMode
+
+			case "PUT", "LINK":
+
+				filename, valid := requestName(input)
+
+				if leanState == kStateGetMode || !valid {
+
+					connLog.Debug("request format error", "input", toParse)
+					connInfo.RecordRequest(strings.ToUpper(input[0]), strings.Join(input[1:], " "), "reqerr", 0, "", time.Now())
+					writer.WriteString("REQERR\n")
+					writer.Flush()
+
+					state = kStateSetup
+					leanState = kStateConfig
+					continue
 
 				}
 
 				filenames = append(make([]string, 0), filename)
 
-				rxLength = 0
+				putVerb = strings.ToUpper(input[0])
+				putStart = time.Now()
+				putCondition = PutCondition{Policy: kPolicyReplace}
+				putRefusal = nil
+				if readOnly {
+					// Decided here so that nothing of the upload is
+					// looked at; its body is only drained.
+					putRefusal = &HookRejection{Reason: ErrReadOnly.Error()}
+				}
+				putChecksum = ""
+				putDigest = ""
+				rxLength = -1
 				state = kStatePutMode
 				leanState = kStatePutMode
 
 			default:
 
-				fmt.Println("[", connx.RemoteAddr(), "] Unrecognised command:", input)
+				// Answered so that a client probing for a newer command can
+				// tell it is not supported.
+				connLog.Debug("unrecognised command", "input", toParse)
+				connInfo.RecordRequest(strings.ToUpper(input[0]), strings.Join(input[1:], " "), "unknown", 0, "", time.Now())
+				writer.WriteString("REQERR\n")
+				writer.Flush()
 				state = kStateSetup
 				leanState = kStateConfig
 
@@ -177,15 +791,83 @@ func ClientHandler(connx *net.TCPConn) {
 
 		case kStateGetMode:
 
-			for i := 0; i < len(filenames); i++ {
+			for i := 0; i < len(getQueue); i++ {
+
+				getStart := time.Now()
+				filename := getQueue[i].Filename
+
+				if getQueue[i].ListTrash {
+
+					entries, error := ListTrash()
+					if error != nil {
+						connLog.Error("error listing trash", "error", error)
+						connInfo.RecordRequest("TRASH", "", "notfound", 0, "", getStart)
+						writer.WriteString("NOTFOUND \n\n")
+						writer.Flush()
+						continue
+					}
+
+					lines := make([]string, 0, len(entries))
+					for j := 0; j < len(entries); j++ {
+						lines = append(lines, FormatTrashEntry(entries[j]))
+					}
+
+					totalSize, sentChecksum := WriteListing(writer, "", lines)
+					connInfo.RecordRequest("TRASH", "", "ok", totalSize, sentChecksum, getStart)
 
-				if filenames[i] == "filelist.txt" || filenames[i] == "" {
+				} else if getQueue[i].ListManifest {
+
+					entries := BuildManifest()
+
+					lines := make([]string, 0, len(entries))
+					for j := 0; j < len(entries); j++ {
+						lines = append(lines, FormatManifestEntry(entries[j]))
+					}
+
+					totalSize, sentChecksum := WriteListing(writer, "", lines)
+					connInfo.RecordRequest("MANIFEST", "", "ok", totalSize, sentChecksum, getStart)
+
+				} else if getQueue[i].ListVersions {
+
+					versions, error := ListVersions(filename)
+					if error != nil {
+						connLog.Debug("error listing versions", "file", filename, "error", error)
+						connInfo.RecordRequest("VERSIONS", filename, "notfound", 0, "", getStart)
+						writer.WriteString("NOTFOUND " + filename + "\n\n")
+						writer.Flush()
+						continue
+					}
+
+					lines := make([]string, 0, len(versions))
+					for j := 0; j < len(versions); j++ {
+						path, _ := VersionPath(filename, versions[j].ID)
+						versionChecksum, _ := FileChecksum(path)
+						lines = append(lines, versions[j].ID+" "+strconv.FormatInt(versions[j].Size, 10)+" "+versionChecksum+" "+versions[j].ModTime.UTC().Format(time.RFC3339))
+					}
+
+					totalSize, sentChecksum := WriteListing(writer, filename, lines)
+					connInfo.RecordRequest("VERSIONS", filename, "ok", totalSize, sentChecksum, getStart)
+
+				} else if Upstream != "" && (filename == "filelist.txt" || filename == "") {
+
+					totalSize, sentChecksum, error := ProxyListing(writer, filename)
+					if error != nil {
+						connLog.Error("error fetching listing from upstream", "upstream", Upstream, "error", error)
+						connInfo.RecordRequest("GET", filename, "readerr", 0, "", getStart)
+						writer.WriteString("READERR " + filename + "\n\n")
+						writer.Flush()
+						continue
+					}
+					connInfo.RecordRequest("GET", filename, "ok", totalSize, sentChecksum, getStart)
+
+				} else if filename == "filelist.txt" || filename == "" {
 
 					localFiles := make([]string, 0)
 					localFilesInfo, error := ioutil.ReadDir("files")
 					if error != nil {
-						fmt.Println("[", connx.RemoteAddr(), "] Directory listing error:", error)
-						writer.WriteString("NOTFOUND " + filenames[i] + "\n\n")
+						connLog.Error("directory listing error", "error", error)
+						connInfo.RecordRequest("GET", filename, "notfound", 0, "", getStart)
+						writer.WriteString("NOTFOUND " + filename + "\n\n")
 						continue
 					}
 
@@ -196,69 +878,178 @@ func ClientHandler(connx *net.TCPConn) {
 						}
 					}
 
-					var totalSize int64 = 0
-					for i := 0; i < len(localFiles); i++ {
-						totalSize += int64(len(localFiles[i]) + 1)
-					}
+					totalSize, sentChecksum := WriteListing(writer, filename, localFiles)
+					connInfo.RecordRequest("GET", filename, "ok", totalSize, sentChecksum, getStart)
 
-					checksum := md5.New()
+				} else {
 
-					writer.WriteString("OK " + filenames[i] + "\n")
-					writer.WriteString("LENGTH " + strconv.FormatInt(totalSize, 10) + "\n\n")
+					// A copy from the proxy cache is opened straight away,
+					// so it cannot be evicted before it is sent.
+					var file *os.File
+					localFile := StorePath(filename)
+					if IsReservedName(filename) {
+						localFile = ""
+					} else if getQueue[i].Version != "" {
+						var valid bool
+						localFile, valid = VersionPath(filename, getQueue[i].Version)
+						if !valid {
+							localFile = ""
+						}
+					} else if Upstream != "" {
+
+						var proxyError error
+						var upstreamChecksum string
+						file, upstreamChecksum, proxyError = CachedFile(filename)
+
+						if proxyError == nil && getQueue[i].IfNoneMatch == upstreamChecksum {
+							if file != nil {
+								file.Close()
+							}
+							connInfo.RecordRequest("GET", filename, "notmodified", 0, upstreamChecksum, getStart)
+							writer.WriteString("NOTMODIFIED " + filename + "\n\n")
+							writer.Flush()
+							continue
+						}
+
+						if proxyError == nil && file == nil && getQueue[i].Ranged {
+							file, proxyError = FillCache(filename)
+						}
+
+						if proxyError == nil && file == nil {
+
+							sentBytes, sentChecksum, started, proxyError := ProxyFetch(writer, filename, connBucket)
+							if proxyError != nil && started && sentChecksum == "" {
+								// The response is cut short; only closing
+								// the connection tells the client.
+								connLog.Error("error relaying file from upstream", "file", filename, "error", proxyError)
+								connInfo.RecordRequest("GET", filename, "readerr", sentBytes, "", getStart)
+								return
+							} else if proxyError == ErrNotFound {
+								connInfo.RecordRequest("GET", filename, "notfound", 0, "", getStart)
+								writer.WriteString("NOTFOUND " + filename + "\n\n")
+								writer.Flush()
+								continue
+							} else if proxyError != nil && !started {
+								connLog.Error("error fetching file from upstream", "file", filename, "error", proxyError)
+								connInfo.RecordRequest("GET", filename, "readerr", 0, "", getStart)
+								writer.WriteString("READERR " + filename + "\n\n")
+								writer.Flush()
+								continue
+							} else if proxyError != nil {
+								connLog.Error("upstream sent corrupt file", "file", filename, "error", proxyError)
+								connInfo.RecordRequest("GET", filename, "hasherr", sentBytes, sentChecksum, getStart)
+								continue
+							}
+
+							connInfo.RecordRequest("GET", filename, "ok", sentBytes, sentChecksum, getStart)
+							continue
+
+						} else if proxyError != nil && proxyError != ErrNotFound {
+							connLog.Error("error checking upstream", "file", filename, "error", proxyError)
+						}
+
+						localFile = ""
+						if file != nil {
+							localFile = file.Name()
+						}
 
-					for i := 0; i < len(localFiles); i++ {
-						checksum.Write([]byte(localFiles[i] + "\n"))
-						writer.WriteString(localFiles[i] + "\n")
 					}
 
-					fmt.Println("[", connx.RemoteAddr(), "] Sent", totalSize, "bytes for index")
-					writer.WriteString("\nCHECKSUM " + fmt.Sprintf("%x", checksum.Sum(make([]byte, 0))) + "\n\n")
-					writer.Flush()
+					if file == nil {
 
-				} else {
+						fileInfo, error := os.Stat(localFile)
+						if error != nil || fileInfo.IsDir() {
+							connLog.Debug("error stat-ing file", "file", localFile, "error", error)
+							connInfo.RecordRequest("GET", filename, "notfound", 0, "", getStart)
+							writer.WriteString("NOTFOUND " + filename + "\n\n")
+							writer.Flush()
+							continue
+						}
+
+						file, error = os.Open(localFile)
+						if error != nil {
+							connLog.Error("error opening file", "file", localFile, "error", error)
+							connInfo.RecordRequest("GET", filename, "readerr", 0, "", getStart)
+							writer.WriteString("READERR " + filename + "\n\n")
+							writer.Flush()
+							continue
+						}
 
-					localFile := "files/" + filenames[i]
+					}
 
-					fileInfo, error := os.Stat(localFile)
-					if error != nil || fileInfo.IsDir() {
-						fmt.Println("[", connx.RemoteAddr(), "] Error stat-ing", localFile, ":", error)
-						writer.WriteString("NOTFOUND " + filenames[i] + "\n\n")
+					// The checksum comes from what was opened, in case the
+					// file was replaced since the Stat above.
+					fileInfo, error := file.Stat()
+					if error != nil {
+						connLog.Error("error reading file", "file", localFile, "error", error)
+						connInfo.RecordRequest("GET", filename, "readerr", 0, "", getStart)
+						writer.WriteString("READERR " + filename + "\n\n")
 						writer.Flush()
+						file.Close()
 						continue
 					}
 
-					file, error := os.Open(localFile)
+					// A range is clamped to the file, so it may come back
+					// shorter than asked for, or empty.
+					offset, length := int64(0), fileInfo.Size()
+					var sentChecksum string
+					if getQueue[i].Ranged {
+						offset, length = getQueue[i].Offset, 0
+						if offset < fileInfo.Size() {
+							length = fileInfo.Size() - offset
+						}
+						if getQueue[i].Length < length {
+							length = getQueue[i].Length
+						}
+						sentChecksum, error = RangeChecksum(file, offset, length)
+					} else {
+						sentChecksum, error = Hashes.Checksum(localFile, file, fileInfo)
+					}
 					if error != nil {
-						fmt.Println("[", connx.RemoteAddr(), "] Error opening", localFile, ":", error)
-						writer.WriteString("READERR " + filenames[i] + "\n\n")
+						connLog.Error("error reading file", "file", localFile, "error", error)
+						connInfo.RecordRequest("GET", filename, "readerr", 0, "", getStart)
+						writer.WriteString("READERR " + filename + "\n\n")
 						writer.Flush()
+						file.Close()
 						continue
 					}
 
-					checksum := md5.New()
-
-					writer.WriteString("OK " + filenames[i] + "\n")
-					writer.WriteString("LENGTH " + strconv.FormatInt(fileInfo.Size(), 10) + "\n\n")
-
-					buffer := make([]byte, 1024)
-					var sentBytes int64 = 0
-					readBytes, error := file.Read(buffer)
-					for error == nil {
-
-						sentBytes += int64(readBytes)
+					if !RangeMatches(getQueue[i], localFile, file, fileInfo) {
+						file.Close()
+						connInfo.RecordRequest("GET", filename, "conflict", 0, "", getStart)
+						writer.WriteString("CONFLICT " + filename + "\n\n")
+						writer.Flush()
+						continue
+					}
 
-						checksum.Write(buffer[:readBytes])
-						writer.WriteString(string(buffer[:readBytes]))
+					if getQueue[i].IfNoneMatch == sentChecksum {
+						file.Close()
+						connInfo.RecordRequest("GET", filename, "notmodified", 0, sentChecksum, getStart)
+						writer.WriteString("NOTMODIFIED " + filename + "\n\n")
+						writer.Flush()
+						continue
+					}
 
-						readBytes, error = file.Read(buffer)
+					writer.WriteString("OK " + filename + "\n")
+					writer.WriteString("LENGTH " + strconv.FormatInt(length, 10) + "\n")
+					writer.WriteString("CHECKSUM " + sentChecksum + "\n\n")
 
+					sentBytes, error := SendBody(connx, writer, file, offset, length, connBucket)
+					file.Close()
+					if error != nil {
+						// The client cannot tell a short body from a slow
+						// one, so the connection has to go.
+						connLog.Error("error sending file", "file", localFile, "error", error)
+						connInfo.RecordRequest("GET", filename, "readerr", sentBytes, "", getStart)
+						return
 					}
 
-					fmt.Println("[", connx.RemoteAddr(), "] Sent", sentBytes, "bytes from file", localFile+".")
-					writer.WriteString("\n\nCHECKSUM " + fmt.Sprintf("%x", checksum.Sum(make([]byte, 0))) + "\n\n")
-					file.Close()
+					connInfo.RecordRequest("GET", filename, "ok", sentBytes, sentChecksum, getStart)
+					writer.WriteString("\n\nCHECKSUM " + sentChecksum + "\n\n")
 					writer.Flush()
 
+					RunPostHooks("GET", HookEvent{Verb: "GET", Name: filename, Path: localFile, Size: sentBytes, Checksum: sentChecksum, Remote: connInfo.Remote})
+
 				}
 
 			}
@@ -270,7 +1061,7 @@ func ClientHandler(connx *net.TCPConn) {
 
 			line, prefix, error := reader.ReadLine()
 			if error != nil {
-				fmt.Println("[", connx.RemoteAddr(), "] Connection terminated:", error)
+				connLog.Info("connection terminated", "error", error)
 				return
 			}
 
@@ -285,64 +1076,103 @@ func ClientHandler(connx *net.TCPConn) {
 
 			if strings.ToUpper(input[0]) == "LENGTH" {
 				if len(input) < 2 {
-					fmt.Println("[", connx.RemoteAddr(), "] Error in header field \"LENGTH\"")
+					connLog.Warn("missing value in header field LENGTH", "verb", "PUT", "file", filenames[0])
 					continue
 				}
 				rxLength, error = strconv.ParseInt(input[1], 10, 64)
 				if error != nil {
-					fmt.Println("[", connx.RemoteAddr(), "] Error parsing header field LENGTH:", error)
+					connLog.Warn("error parsing header field LENGTH", "verb", "PUT", "file", filenames[0], "error", error)
 					continue
 				}
-			} else if input[0] == "" && rxLength > 0 {
-				state = kStatePutReceive
-			}
-
-		case kStatePutReceive:
-
-			var count int64
-			checksum := md5.New()
-			buffer := make([]byte, 1024)
-
-			localFile := "files/" + filenames[0] + "-part"
+			} else if strings.ToUpper(input[0]) == "IF-NONE-MATCH" {
+				// Only "*" is meaningful: create the file if it does not exist.
+				putCondition = PutCondition{Policy: kPolicyCreate}
+			} else if strings.ToUpper(input[0]) == "IF-MATCH" {
+				if len(input) < 2 {
+					connLog.Warn("missing value in header field IF-MATCH", "verb", "PUT", "file", filenames[0])
+					continue
+				}
+				putCondition = PutCondition{Policy: kPolicyMatch, Expected: strings.ToLower(input[1])}
+			} else if strings.ToUpper(input[0]) == "CHECKSUM" && len(input) > 1 {
+				putChecksum = strings.ToLower(input[1])
+			} else if strings.ToUpper(input[0]) == "SHA256" && len(input) > 1 {
+				putDigest = strings.ToLower(input[1])
+			} else if input[0] == "" && putVerb == "LINK" {
+
+				// LINK names contents the server may already hold; no body
+				// follows, and NOTFOUND tells the client to PUT instead.
+				hookEvent := HookEvent{Verb: "PUT", Name: filenames[0], Size: rxLength, Checksum: putChecksum, Remote: connInfo.Remote}
+
+				linkError := ErrNoBlob
+				if putRefusal != nil {
+					linkError = putRefusal
+				} else if blobPath, found := FindBlob(putDigest, rxLength); found {
+					hookEvent.Path = blobPath
+					linkError = RunPrePutHooks(hookEvent)
+					if linkError == nil {
+						linkError = LinkBlob(filenames[0], putDigest, rxLength, putCondition)
+					}
+				}
 
-			file, error := os.Create(localFile)
-			if error != nil {
+				response, outcome := CommitResponse(filenames[0], linkError)
+				if outcome == "wrerr" {
+					connLog.Error("error linking file", "file", filenames[0], "error", linkError)
+				}
 
-				fmt.Println("[", connx.RemoteAddr(), "] Error creating", localFile, ":", error)
-				writer.WriteString("WRERR " + filenames[0] + "\n\n")
+				connInfo.RecordRequest("LINK", filenames[0], outcome, 0, putChecksum, putStart)
+				writer.WriteString(response + "\n\n")
 				writer.Flush()
 
+				if linkError == nil {
+					hookEvent.Path = StorePath(filenames[0])
+					RunPostHooks("PUT", hookEvent)
+				}
+
 				state = kStateSetup
 				leanState = kStateConfig
-				continue
-
-			}
-			defer file.Close()
 
-			for count < rxLength-1024 {
+			} else if input[0] == "" && rxLength >= 0 {
 
-				readBytes, error := reader.Read(buffer)
-				if error != nil {
-					fmt.Println("[", connx.RemoteAddr(), "] Connection terminated:", error)
-					return
+				// An upload that is refused whatever its contents is
+				// refused now, and its body only drained. Pre-PUT hooks
+				// decide on the name and length alone.
+				if putRefusal == nil {
+					putRefusal = CheckCondition(StorePath(filenames[0]), &putCondition)
+				}
+				if putRefusal == nil {
+					putRefusal = RunPrePutHooks(HookEvent{Verb: "PUT", Name: filenames[0], Size: rxLength, Remote: connInfo.Remote})
 				}
-				count += int64(readBytes)
-				checksum.Write(buffer[:readBytes])
-				file.Write(buffer[:readBytes])
+				state = kStatePutReceive
 
 			}
 
-			smallBuffer := make([]byte, 1)
+		case kStatePutReceive:
 
-			for count < rxLength {
-				readBytes, error := reader.Read(smallBuffer)
-				if error != nil {
-					fmt.Println("[", connx.RemoteAddr(), "] Connection terminated:", error)
-					return
+			writeError := putRefusal
+
+			localFile := StorePath(filenames[0])
+
+			// The body is always drained, even if it cannot be stored, so
+			// that the connection stays in step with the client.
+			var dest io.Writer = io.Discard
+			var file *os.File
+			if writeError == nil {
+				file, writeError = CreateTemp(localFile)
+				if writeError != nil {
+					connLog.Error("error creating temporary file", "file", localFile, "error", writeError)
+				} else {
+					dest = file
 				}
-				count += int64(readBytes)
-				checksum.Write(smallBuffer[:readBytes])
-				file.Write(smallBuffer[:readBytes])
+			}
+
+			receivedChecksum, receiveError, error := common.ReceiveBody(reader, dest, rxLength, connBucket, GlobalBucket)
+			if error != nil {
+				connLog.Info("connection terminated", "error", error)
+				DiscardTemp(file)
+				return
+			}
+			if writeError == nil {
+				writeError = receiveError
 			}
 
 			temp := make([]string, 0)
@@ -351,7 +1181,8 @@ func ClientHandler(connx *net.TCPConn) {
 
 				line, prefix, error := reader.ReadLine()
 				if error != nil {
-					fmt.Println("[", connx.RemoteAddr(), "] Connection terminated:", error)
+					connLog.Info("connection terminated", "error", error)
+					DiscardTemp(file)
 					return
 				}
 
@@ -371,32 +1202,49 @@ func ClientHandler(connx *net.TCPConn) {
 					continue
 				}
 
-				if inputChecksum != fmt.Sprintf("%x", checksum.Sum(make([]byte, 0))) {
+				state = kStateSetup
+				leanState = kStateConfig
+
+				if inputChecksum != receivedChecksum {
 
-					fmt.Println("[", connx.RemoteAddr(), "] Hash mismatch. Sender claimed", inputChecksum+", received", fmt.Sprintf("%x", checksum.Sum(make([]byte, 0))))
+					connLog.Warn("hash mismatch", "file", filenames[0], "claimed", inputChecksum, "received", receivedChecksum)
+					connInfo.RecordRequest("PUT", filenames[0], "hasherr", rxLength, receivedChecksum, putStart)
+					DiscardTemp(file)
 					writer.WriteString("HASHERR " + filenames[0] + "\n\n")
 					writer.Flush()
-
-					state = kStateSetup
-					leanState = kStateConfig
 					break
 
 				}
 
-				os.Rename(localFile, localFile[:len(localFile)-5])
-				fmt.Println("[", connx.RemoteAddr(), "] Wrote", strconv.FormatInt(count, 10), "bytes to file", localFile[:len(localFile)-5])
-				writer.WriteString("RECV " + filenames[0] + "\n\n")
+				hookEvent := HookEvent{Verb: "PUT", Name: filenames[0], Size: rxLength, Checksum: inputChecksum, Remote: connInfo.Remote}
+
+				if writeError == nil {
+					writeError = CommitFile(file, filenames[0], putCondition)
+				}
+
+				response, outcome := CommitResponse(filenames[0], writeError)
+				if outcome == "wrerr" {
+					connLog.Error("error writing file", "file", localFile, "error", writeError)
+				}
+				if writeError != nil {
+					DiscardTemp(file)
+				}
+
+				connInfo.RecordRequest("PUT", filenames[0], outcome, rxLength, inputChecksum, putStart)
+				writer.WriteString(response + "\n\n")
 				writer.Flush()
 
-				state = kStateSetup
-				leanState = kStateConfig
+				if writeError == nil {
+					hookEvent.Path = localFile
+					RunPostHooks("PUT", hookEvent)
+				}
 				break
 
 			}
 
 		case kStateTeardown:
 
-			fmt.Println("[", connx.RemoteAddr(), "] Connection closed by client")
+			connLog.Debug("connection closed by client")
 			return
 
 		}
@@ -407,28 +1255,84 @@ func main() {
 
 	InitFlags()
 
-	listenPort := ":" + Port
-	tcpAddress, error := net.ResolveTCPAddr("tcp", listenPort)
-	if error != nil {
-		fmt.Println("Error resolving listening address:", error)
-		return
+	if HashCachePath != "" {
+		cache, error := OpenHashCache(HashCachePath)
+		if error != nil {
+			Log.Warn("error opening hash cache, keeping it in memory", "file", HashCachePath, "error", error)
+		} else {
+			Hashes = cache
+		}
 	}
 
-	tcpListener, error := net.ListenTCP("tcp", tcpAddress)
-	if error != nil {
-		fmt.Println("Error while attempting to listen:", error)
-		return
+	// Every address is bound before any is served, so a mistake in one
+	// stops the server rather than leaving it half listening.
+	netListeners := make([]net.Listener, len(Listeners))
+	for i := 0; i < len(Listeners); i++ {
+		netListener, error := Listeners[i].Listen()
+		if error != nil {
+			Log.Error("error while attempting to listen", "address", Listeners[i].String(), "error", error)
+			return
+		}
+		defer netListener.Close()
+		netListeners[i] = netListener
 	}
-	defer tcpListener.Close()
 
-	for {
+	var httpListener, webDAVListener net.Listener
+	if HTTPListener != nil {
+		netListener, error := HTTPListener.ListenHTTP()
+		if error != nil {
+			Log.Error("error while attempting to listen", "address", HTTPListener.String(), "error", error)
+			return
+		}
+		defer netListener.Close()
+		httpListener = netListener
+	}
+	if WebDAVListener != nil {
+		netListener, error := WebDAVListener.ListenHTTP()
+		if error != nil {
+			Log.Error("error while attempting to listen", "address", WebDAVListener.String(), "error", error)
+			return
+		}
+		defer netListener.Close()
+		webDAVListener = netListener
+	}
+
+	if TrashRetention > 0 {
+		go PurgeTrashEvery(time.Minute)
+	}
+	go PruneHashesEvery(10 * time.Minute)
 
-		connx, error := tcpListener.AcceptTCP()
+	if StoreBackend == "cas" {
+		error := IndexBlobs()
 		if error != nil {
-			fmt.Println("Error while accepting connection:", error)
-			continue
+			Log.Warn("error indexing blobs", "error", error)
 		}
+		go CollectBlobsEvery(10 * time.Minute)
+	}
+
+	if MetricsAddr != "" {
+		go ServeMetrics(MetricsAddr)
+	}
+
+	if HTTPListener != nil {
+		go ServeHTTPGateway(HTTPListener, httpListener)
+	}
+
+	if WebDAVListener != nil {
+		go ServeWebDAV(WebDAVListener, webDAVListener)
+	}
+
+	if Primary != "" {
+		RegisterPrePutHook(RejectWrites)
+		go Follow(Primary)
+	}
+
+	if Upstream != "" {
+		RegisterPrePutHook(RejectWrites)
+	}
 
-		go ClientHandler(connx)
+	for i := 1; i < len(Listeners); i++ {
+		go Listeners[i].Serve(netListeners[i])
 	}
+	Listeners[0].Serve(netListeners[0])
 }
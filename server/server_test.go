@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../common"
+)
+
+const kBenchFileSize = 64 * 1024 * 1024
+
+// benchConn is a loopback TCP connection whose far end discards everything
+// sent to it.
+func benchConn(b *testing.B) *net.TCPConn {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			connx, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, connx)
+		}
+	}()
+
+	connx, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { connx.Close() })
+
+	return connx.(*net.TCPConn)
+
+}
+
+func benchFile(b *testing.B) *os.File {
+
+	path := filepath.Join(b.TempDir(), "body")
+	data := make([]byte, kBenchFileSize)
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i * 7)
+	}
+	err := ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { file.Close() })
+
+	return file
+
+}
+
+// wrappedConn hides the TCP connection from SendBody, as TLS does, so the
+// body goes through a body buffer.
+type wrappedConn struct {
+	net.Conn
+}
+
+// BenchmarkSendBody compares sending a body straight from the file to the
+// socket, which Linux does with sendfile(2), with copying it through a body
+// buffer, and with the 1 KiB reads and string conversions the
+// GET path used before.
+func BenchmarkSendBody(b *testing.B) {
+
+	b.Run("sendfile", func(b *testing.B) {
+		connx, file := benchConn(b), benchFile(b)
+		writer := bufio.NewWriter(connx)
+		b.SetBytes(kBenchFileSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := SendBody(connx, writer, file, 0, kBenchFileSize, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("buffered", func(b *testing.B) {
+		connx, file := wrappedConn{benchConn(b)}, benchFile(b)
+		writer := bufio.NewWriter(connx)
+		b.SetBytes(kBenchFileSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := SendBody(connx, writer, file, 0, kBenchFileSize, nil)
+			if err == nil {
+				err = writer.Flush()
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("1k-chunks", func(b *testing.B) {
+		connx, file := benchConn(b), benchFile(b)
+		writer := bufio.NewWriter(connx)
+		buffer := make([]byte, 1024)
+		b.SetBytes(kBenchFileSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			file.Seek(0, io.SeekStart)
+			for {
+				readBytes, err := file.Read(buffer)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					b.Fatal(err)
+				}
+				writer.WriteString(string(buffer[:readBytes]))
+			}
+			writer.Flush()
+		}
+	})
+
+}
+
+// benchSource is a loopback TCP connection whose far end sends an endless
+// stream of data, read as ClientHandler reads it.
+func benchSource(b *testing.B) *bufio.Reader {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+
+	go func() {
+		connx, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		data := make([]byte, 256*1024)
+		for {
+			if _, err := connx.Write(data); err != nil {
+				connx.Close()
+				return
+			}
+		}
+	}()
+
+	connx, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { connx.Close() })
+
+	return bufio.NewReader(connx)
+
+}
+
+// receiveTail reads a body the way PUT did before ReceiveBody: 1 KiB reads
+// until the last KiB, then one byte at a time, writing each read to dest.
+func receiveTail(reader *bufio.Reader, dest io.Writer, length int64) (string, error) {
+
+	var count int64
+	checksum := md5.New()
+	buffer := make([]byte, 1024)
+
+	for count < length-1024 {
+		readBytes, err := reader.Read(buffer)
+		if err != nil {
+			return "", err
+		}
+		count += int64(readBytes)
+		checksum.Write(buffer[:readBytes])
+		dest.Write(buffer[:readBytes])
+	}
+
+	smallBuffer := make([]byte, 1)
+	for count < length {
+		readBytes, err := reader.Read(smallBuffer)
+		if err != nil {
+			return "", err
+		}
+		count += int64(readBytes)
+		checksum.Write(smallBuffer[:readBytes])
+		dest.Write(smallBuffer[:readBytes])
+	}
+
+	return fmt.Sprintf("%x", checksum.Sum(nil)), nil
+
+}
+
+func benchDest(b *testing.B) *os.File {
+
+	file, err := os.Create(filepath.Join(b.TempDir(), "received"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { file.Close() })
+
+	return file
+
+}
+
+// BenchmarkReceiveBody compares receiving small and large PUT bodies into a
+// file with common.ReceiveBody against the old one-byte tail loop.
+func BenchmarkReceiveBody(b *testing.B) {
+
+	sizes := []struct {
+		name   string
+		length int64
+	}{
+		{"small", 4000},
+		{"large", kBenchFileSize},
+	}
+
+	for _, size := range sizes {
+
+		length := size.length
+
+		b.Run(size.name+"/buffered", func(b *testing.B) {
+			reader, file := benchSource(b), benchDest(b)
+			b.SetBytes(length)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				file.Seek(0, io.SeekStart)
+				_, writeErr, err := common.ReceiveBody(reader, file, length)
+				if err == nil {
+					err = writeErr
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(size.name+"/1-byte-tail", func(b *testing.B) {
+			reader, file := benchSource(b), benchDest(b)
+			b.SetBytes(length)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				file.Seek(0, io.SeekStart)
+				_, err := receiveTail(reader, file, length)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+	}
+
+}
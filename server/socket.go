@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	// SocketPath is where the Unix socket listener given by -socket is
+	// created. It is disabled if empty.
+	SocketPath  string
+	SocketMode  os.FileMode
+	SocketUsers map[uint32]bool
+)
+
+// PeerCredentials identifies the process at the other end of a Unix socket.
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// String is used as the remote address in logs, audit records and the
+// TCPFT_REMOTE variable given to hooks.
+func (creds PeerCredentials) String() string {
+	return "unix:uid=" + strconv.FormatUint(uint64(creds.UID), 10) +
+		",gid=" + strconv.FormatUint(uint64(creds.GID), 10) +
+		",pid=" + strconv.FormatInt(int64(creds.PID), 10)
+}
+
+// ParseSocketUsers resolves a comma-separated list of user names and
+// numeric user IDs.
+func ParseSocketUsers(list string) (map[uint32]bool, error) {
+
+	users := make(map[uint32]bool)
+
+	for _, name := range strings.Split(list, ",") {
+
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+			users[uint32(uid)] = true
+			continue
+		}
+
+		account, err := user.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseUint(account.Uid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		users[uint32(uid)] = true
+
+	}
+
+	return users, nil
+
+}
+
+// unixListener removes its socket when closed, as the listener net.Listen
+// returns would had the socket been bound where it ends up.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (listener unixListener) Close() error {
+	err := listener.UnixListener.Close()
+	os.Remove(listener.path)
+	return err
+}
+
+// listenUnix binds a Unix socket inside a private directory next to its
+// path, gives it its mode there and only then renames it into place, so
+// that nobody can connect while it has the permissions of the umask. Only
+// users with write permission on it can connect. Something already at the
+// path is replaced only if it is a socket nothing is listening on.
+func (listener *Listener) listenUnix() (net.Listener, error) {
+
+	path := listener.Address
+
+	if connx, err := net.Dial("unix", path); err == nil {
+		connx.Close()
+		return nil, fmt.Errorf("%s is in use by another server", path)
+	} else if fileInfo, statErr := os.Lstat(path); statErr == nil {
+		if fileInfo.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		} else if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".tcpft-socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	bound := filepath.Join(dir, "socket")
+	netListener, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	netListener.SetUnlinkOnClose(false)
+
+	err = os.Chmod(bound, listener.Mode)
+	if err == nil {
+		err = os.Rename(bound, path)
+	}
+	if err != nil {
+		netListener.Close()
+		return nil, err
+	}
+
+	return unixListener{netListener, path}, nil
+
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials asks the kernel which process opened connx.
+func peerCredentials(connx *net.UnixConn) (PeerCredentials, error) {
+
+	raw, err := connx.SyscallConn()
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credError error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credError = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credError
+	}
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+
+	return PeerCredentials{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+
+}
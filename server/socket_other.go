@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials relies on SO_PEERCRED, which only Linux has.
+func peerCredentials(connx *net.UnixConn) (PeerCredentials, error) {
+	return PeerCredentials{}, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	kPolicyReplace = iota
+	kPolicyCreate
+	kPolicyMatch
+)
+
+// PutCondition decides whether a PUT may take effect given what is already
+// stored under its name.
+type PutCondition struct {
+	Policy   int
+	Expected string
+
+	// The file found by the last successful CheckCondition, if any.
+	checked bool
+	matched os.FileInfo
+}
+
+const kFilesDir = "files"
+
+var (
+	ErrExists   = errors.New("file already exists")
+	ErrConflict = errors.New("current contents do not match expected checksum")
+
+	// Serialises condition checks with the renames that depend on them.
+	commitMutex sync.Mutex
+)
+
+// StorePath is the location on disk of the file clients know as name.
+func StorePath(name string) string {
+	return filepath.Join(kFilesDir, filepath.FromSlash(name))
+}
+
+// CreateTemp opens a uniquely named temporary file in the same directory as
+// localFile, creating the directory if needed, so that concurrent uploads of
+// one name never share a file and the final rename stays on one filesystem.
+// The name starts with a dot to keep it out of the index.
+func CreateTemp(localFile string) (*os.File, error) {
+
+	err := os.MkdirAll(filepath.Dir(localFile), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(localFile), "."+filepath.Base(localFile)+"-part-")
+	if err != nil {
+		return nil, err
+	}
+
+	// TempFile creates files readable only by us; match os.Create instead.
+	err = file.Chmod(0644)
+	if err != nil {
+		DiscardTemp(file)
+		return nil, err
+	}
+
+	return file, nil
+
+}
+
+// CommitFile flushes the fully written temporary file to disk, closes it and,
+// if condition allows, renames it over the stored file called name, then
+// syncs the directory so the rename itself survives a crash. If that sync
+// fails the error is returned, so the commit is not acknowledged as durable
+// even though the file is already in place. With the "cas" backend the
+// contents go to the blob area under their SHA-256 and name becomes a link
+// to them. The previous contents are kept as described at
+// PreserveReplaced. ErrExists or ErrConflict is returned when the condition
+// fails; a condition already checked with CheckCondition is only confirmed.
+// On any error the temporary file is left for the caller to discard.
+func CommitFile(file *os.File, name string, condition PutCondition) error {
+
+	localFile := StorePath(name)
+
+	err := file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	if !condition.checked {
+		err = CheckCondition(localFile, &condition)
+		if err != nil {
+			return err
+		}
+	}
+
+	var digest string
+	if StoreBackend == "cas" {
+		digest, err = BlobDigest(file.Name())
+		if err != nil {
+			return err
+		}
+	}
+
+	commitMutex.Lock()
+
+	err = confirmCondition(localFile, condition)
+	if err == nil {
+		err = PreserveReplaced(localFile, name)
+	}
+	if err == nil && StoreBackend == "cas" {
+		var blobPath string
+		blobPath, err = storeBlob(file.Name(), digest)
+		if err == nil {
+			err = placeBlob(blobPath, localFile)
+		}
+	} else if err == nil {
+		err = os.Rename(file.Name(), localFile)
+	}
+
+	commitMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	err = SyncDir(filepath.Dir(localFile))
+	if err != nil {
+		Log.Error("error syncing directory after commit", "file", localFile, "error", err)
+	}
+
+	return err
+
+}
+
+// PreserveReplaced keeps the contents of localFile, about to be replaced, as
+// a version if versioning is enabled, and otherwise in the trash if that is
+// enabled. Callers hold commitMutex.
+func PreserveReplaced(localFile string, name string) error {
+	if KeepVersions > 0 || VersionAge > 0 {
+		return SnapshotVersion(localFile, name)
+	}
+	return TrashCopy(localFile, name)
+}
+
+// CheckCondition reports whether a PUT under condition may replace whatever
+// is currently at localFile, and remembers the file it found. Matching can
+// mean reading the whole file, so this is done before the body is received
+// and without commitMutex; confirmCondition later repeats it cheaply.
+func CheckCondition(localFile string, condition *PutCondition) error {
+
+	switch condition.Policy {
+
+	case kPolicyCreate:
+
+		_, err := os.Lstat(localFile)
+		if err == nil {
+			return ErrExists
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+	case kPolicyMatch:
+
+		file, err := os.Open(localFile)
+		if os.IsNotExist(err) {
+			return ErrConflict
+		} else if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		current, err := Hashes.Checksum(localFile, file, fileInfo)
+		if err != nil {
+			return err
+		}
+		if current != condition.Expected {
+			return ErrConflict
+		}
+		condition.matched = fileInfo
+
+	}
+
+	condition.checked = true
+	return nil
+
+}
+
+// confirmCondition makes sure a condition that passed CheckCondition still
+// holds: the file must still be missing, or still be the same file, by inode,
+// size and modification time, that was hashed. Callers hold commitMutex.
+func confirmCondition(localFile string, condition PutCondition) error {
+
+	switch condition.Policy {
+
+	case kPolicyCreate:
+
+		_, err := os.Lstat(localFile)
+		if err == nil {
+			return ErrExists
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+	case kPolicyMatch:
+
+		fileInfo, err := os.Stat(localFile)
+		if os.IsNotExist(err) {
+			return ErrConflict
+		} else if err != nil {
+			return err
+		}
+		matched := condition.matched
+		if matched == nil || !os.SameFile(fileInfo, matched) || fileInfo.Size() != matched.Size() || !fileInfo.ModTime().Equal(matched.ModTime()) {
+			return ErrConflict
+		}
+
+	}
+
+	return nil
+
+}
+
+// FileChecksum returns the hex MD5 of the file at localFile, from the hash
+// cache while the file is unchanged.
+func FileChecksum(localFile string) (string, error) {
+
+	file, err := os.Open(localFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	return Hashes.Checksum(localFile, file, fileInfo)
+
+}
+
+// MoveFile renames the stored file or directory from to to. Unless overwrite
+// is set, ErrExists is returned if to already exists; a file it replaces is
+// kept as described at PreserveReplaced, and a directory goes to the trash.
+func MoveFile(from string, to string, overwrite bool) error {
+
+	source := StorePath(from)
+	target := StorePath(to)
+
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	_, err := os.Lstat(source)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	targetInfo, err := os.Lstat(target)
+	if err == nil && !overwrite {
+		return ErrExists
+	} else if err == nil && targetInfo.IsDir() {
+		err = TrashTree(target, to)
+	} else if err == nil {
+		err = PreserveReplaced(target, to)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(source, target)
+	if err != nil {
+		return err
+	}
+
+	SyncDir(filepath.Dir(source))
+	return SyncDir(filepath.Dir(target))
+
+}
+
+// StatFile returns the size and checksum of the stored file called name, or
+// ErrNotFound.
+func StatFile(name string) (int64, string, error) {
+
+	localFile := StorePath(name)
+
+	fileInfo, err := os.Stat(localFile)
+	if os.IsNotExist(err) || (err == nil && !fileInfo.Mode().IsRegular()) {
+		return 0, "", ErrNotFound
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	checksum, err := FileChecksum(localFile)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return fileInfo.Size(), checksum, nil
+
+}
+
+// DiscardTemp closes and removes a temporary file that will not be
+// committed. It is safe to call with a nil file or after CommitFile failed.
+func DiscardTemp(file *os.File) {
+	if file == nil {
+		return
+	}
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// SyncDir flushes directory entries, such as a completed rename, to disk.
+func SyncDir(dir string) error {
+
+	handle, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	return handle.Sync()
+
+}
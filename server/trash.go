@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const kTrashDir = "files/.trash"
+
+// TrashRetention is how long deleted and overwritten files stay recoverable.
+// Zero disables the trash, so deletions are permanent.
+var TrashRetention time.Duration
+
+var ErrNotFound = errors.New("file not found")
+
+// TrashEntry describes one recoverable file. Entries live at
+// files/.trash/<id>/<name>, where id is the deletion time in nanoseconds.
+type TrashEntry struct {
+	ID        string
+	Name      string
+	Size      int64
+	DeletedAt time.Time
+}
+
+func trashPath(id string, name string) string {
+	return filepath.Join(kTrashDir, id, filepath.FromSlash(name))
+}
+
+func newTrashSlot(name string) (string, error) {
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return trashPath(id, name), os.MkdirAll(filepath.Dir(trashPath(id, name)), 0755)
+}
+
+// TrashCopy links the current contents of localFile, stored as name, into
+// the trash before they are overwritten. Callers hold commitMutex.
+func TrashCopy(localFile string, name string) error {
+
+	if TrashRetention <= 0 {
+		return nil
+	}
+
+	fileInfo, err := os.Lstat(localFile)
+	if os.IsNotExist(err) || (err == nil && !fileInfo.Mode().IsRegular()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	slot, err := newTrashSlot(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Link(localFile, slot)
+
+}
+
+// TrashTree moves the directory localFile, stored as name, and everything
+// in it to the trash, or removes it if the trash is disabled. Each file in
+// it can then be undeleted by its own name. Callers hold commitMutex.
+func TrashTree(localFile string, name string) error {
+
+	if TrashRetention <= 0 {
+		return os.RemoveAll(localFile)
+	}
+
+	slot, err := newTrashSlot(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(localFile, slot)
+
+}
+
+// DeleteFile removes the stored file called name, moving it to the trash if
+// the trash is enabled.
+func DeleteFile(name string) error {
+
+	localFile := StorePath(name)
+
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	fileInfo, err := os.Lstat(localFile)
+	if os.IsNotExist(err) || (err == nil && !fileInfo.Mode().IsRegular()) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if TrashRetention <= 0 {
+		err = os.Remove(localFile)
+	} else {
+		var slot string
+		slot, err = newTrashSlot(name)
+		if err == nil {
+			err = os.Rename(localFile, slot)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return SyncDir(filepath.Dir(localFile))
+
+}
+
+// ListTrash returns every recoverable file, most recently deleted first.
+func ListTrash() ([]TrashEntry, error) {
+
+	slots, err := ioutil.ReadDir(kTrashDir)
+	if os.IsNotExist(err) {
+		return make([]TrashEntry, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries := make([]TrashEntry, 0)
+
+	for i := 0; i < len(slots); i++ {
+
+		nanos, err := strconv.ParseInt(slots[i].Name(), 10, 64)
+		if err != nil || !slots[i].IsDir() {
+			continue
+		}
+
+		slotDir := filepath.Join(kTrashDir, slots[i].Name())
+		filepath.Walk(slotDir, func(path string, fileInfo os.FileInfo, err error) error {
+			if err != nil || !fileInfo.Mode().IsRegular() {
+				return nil
+			}
+			relative, _ := filepath.Rel(slotDir, path)
+			entries = append(entries, TrashEntry{
+				ID:        slots[i].Name(),
+				Name:      filepath.ToSlash(relative),
+				Size:      fileInfo.Size(),
+				DeletedAt: time.Unix(0, nanos),
+			})
+			return nil
+		})
+
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+
+	return entries, nil
+
+}
+
+// Undelete puts the trashed copy of name with the given id back in place, or
+// the most recent one if id is empty. Whatever currently has that name is
+// itself moved to the trash first, so nothing is lost.
+func Undelete(name string, id string) error {
+
+	if id == "" {
+
+		entries, err := ListTrash()
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(entries); i++ {
+			if entries[i].Name == name {
+				id = entries[i].ID
+				break
+			}
+		}
+
+		if id == "" {
+			return ErrNotFound
+		}
+
+	} else if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return ErrNotFound
+	}
+
+	source := trashPath(id, name)
+	localFile := StorePath(name)
+
+	commitMutex.Lock()
+	defer commitMutex.Unlock()
+
+	_, err := os.Lstat(source)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	err = TrashCopy(localFile, name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(localFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(source, localFile)
+	if err != nil {
+		return err
+	}
+
+	return SyncDir(filepath.Dir(localFile))
+
+}
+
+// PurgeTrash permanently removes trash entries older than TrashRetention.
+// Each is removed under commitMutex, so an UNDELETE of it either completes
+// first or finds it gone.
+func PurgeTrash() {
+
+	slots, err := ioutil.ReadDir(kTrashDir)
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < len(slots); i++ {
+		nanos, err := strconv.ParseInt(slots[i].Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		if time.Since(time.Unix(0, nanos)) > TrashRetention {
+			commitMutex.Lock()
+			os.RemoveAll(filepath.Join(kTrashDir, slots[i].Name()))
+			commitMutex.Unlock()
+		}
+	}
+
+}
+
+// PurgeTrashEvery runs PurgeTrash periodically, forever.
+func PurgeTrashEvery(interval time.Duration) {
+	for {
+		PurgeTrash()
+		time.Sleep(interval)
+	}
+}
+
+// FormatTrashEntry renders an entry as a line of the TRASH listing.
+func FormatTrashEntry(entry TrashEntry) string {
+	return strings.Join([]string{
+		entry.ID,
+		entry.Name,
+		strconv.FormatInt(entry.Size, 10),
+		entry.DeletedAt.UTC().Format(time.RFC3339),
+	}, " ")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const kVersionsDir = "files/.versions"
+
+var (
+	KeepVersions int
+	VersionAge   time.Duration
+)
+
+// VersionInfo describes one retained revision of a file.
+type VersionInfo struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+}
+
+// VersionDir is where prior revisions of the file stored as name are kept.
+func VersionDir(name string) string {
+	return filepath.Join(kVersionsDir, filepath.FromSlash(name))
+}
+
+// VersionPath is the location of revision id of name. IDs are plain
+// integers, so anything else cannot escape the versions area.
+func VersionPath(name string, id string) (string, bool) {
+	_, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(VersionDir(name), id), true
+}
+
+// SnapshotVersion preserves the current contents of localFile, stored as
+// name, before they are replaced. It is a no-op when versioning is off or
+// there is nothing to preserve. Callers hold commitMutex.
+func SnapshotVersion(localFile string, name string) error {
+
+	if KeepVersions <= 0 && VersionAge <= 0 {
+		return nil
+	}
+
+	fileInfo, err := os.Lstat(localFile)
+	if os.IsNotExist(err) || (err == nil && !fileInfo.Mode().IsRegular()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	dir := VersionDir(name)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// A hard link keeps the old inode alive without copying it, and the
+	// caller's rename then replaces the name without a gap.
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	err = os.Link(localFile, filepath.Join(dir, id))
+	if err != nil {
+		return err
+	}
+
+	PruneVersions(name)
+	return nil
+
+}
+
+// ListVersions returns the retained revisions of name, newest first.
+func ListVersions(name string) ([]VersionInfo, error) {
+
+	entries, err := ioutil.ReadDir(VersionDir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]VersionInfo, 0, len(entries))
+	for i := 0; i < len(entries); i++ {
+		if !entries[i].Mode().IsRegular() {
+			continue
+		}
+		_, err := strconv.ParseInt(entries[i].Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, VersionInfo{
+			ID:      entries[i].Name(),
+			Size:    entries[i].Size(),
+			ModTime: entries[i].ModTime(),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		left, _ := strconv.ParseInt(versions[i].ID, 10, 64)
+		right, _ := strconv.ParseInt(versions[j].ID, 10, 64)
+		return left > right
+	})
+
+	return versions, nil
+
+}
+
+// PruneVersions drops revisions of name beyond the configured count or age.
+func PruneVersions(name string) {
+
+	versions, err := ListVersions(name)
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < len(versions); i++ {
+
+		id, _ := strconv.ParseInt(versions[i].ID, 10, 64)
+		expired := VersionAge > 0 && time.Since(time.Unix(0, id)) > VersionAge
+
+		if (KeepVersions > 0 && i >= KeepVersions) || expired {
+			path, _ := VersionPath(name, versions[i].ID)
+			os.Remove(path)
+		}
+
+	}
+
+}
+
+// IsReservedName reports whether name falls inside one of the hidden areas
+// the server manages itself, which clients may not address directly.
+func IsReservedName(name string) bool {
+	first := strings.SplitN(filepath.ToSlash(name), "/", 2)[0]
+	return first == ".versions" || first == ".blobs" || first == ".trash" || strings.HasPrefix(first, ".hashes")
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../common"
+)
+
+const (
+	kEventCreated  = "CREATED"
+	kEventModified = "MODIFIED"
+	kEventDeleted  = "DELETED"
+)
+
+// ChangeEvent reports that a file under the server root changed, whether
+// through this protocol or directly on disk.
+type ChangeEvent struct {
+	Kind     string
+	Name     string
+	Size     int64
+	Checksum string
+}
+
+// Line renders the event as sent to WATCH clients.
+func (event ChangeEvent) Line() string {
+	checksum := event.Checksum
+	if checksum == "" {
+		checksum = "-"
+	}
+	return "EVENT " + event.Kind + " " + event.Name + " " + strconv.FormatInt(event.Size, 10) + " " + checksum
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// ChangeFeed scans the files directory whenever it may have changed and
+// fans the differences out to subscribers.
+type ChangeFeed struct {
+	mutex       sync.Mutex
+	known       map[string]fileState
+	subscribers map[chan ChangeEvent]bool
+	rescan      chan bool
+}
+
+var (
+	Changes    *ChangeFeed
+	changeOnce sync.Once
+)
+
+// StartChangeFeed starts watching the files directory the first time it is
+// called and returns the shared feed.
+func StartChangeFeed() *ChangeFeed {
+
+	changeOnce.Do(func() {
+
+		Changes = &ChangeFeed{
+			known:       make(map[string]fileState),
+			subscribers: make(map[chan ChangeEvent]bool),
+			rescan:      make(chan bool, 1),
+		}
+
+		Changes.scan(false)
+		go Changes.run()
+		go watchDirectory(kFilesDir, Changes.Trigger)
+
+	})
+
+	return Changes
+
+}
+
+// Trigger asks for a rescan. Bursts of triggers collapse into one.
+func (feed *ChangeFeed) Trigger() {
+	select {
+	case feed.rescan <- true:
+	default:
+	}
+}
+
+// Subscribe returns a channel receiving every subsequent event.
+func (feed *ChangeFeed) Subscribe() chan ChangeEvent {
+	events := make(chan ChangeEvent, 256)
+	feed.mutex.Lock()
+	feed.subscribers[events] = true
+	feed.mutex.Unlock()
+	return events
+}
+
+func (feed *ChangeFeed) Unsubscribe(events chan ChangeEvent) {
+	feed.mutex.Lock()
+	delete(feed.subscribers, events)
+	feed.mutex.Unlock()
+}
+
+func (feed *ChangeFeed) run() {
+	for range feed.rescan {
+		// Let a burst of writes settle before looking.
+		time.Sleep(100 * time.Millisecond)
+		feed.scan(true)
+	}
+}
+
+// scan compares the directory against the last scan and, if publish is
+// set, sends an event for every difference.
+func (feed *ChangeFeed) scan(publish bool) {
+
+	current := make(map[string]fileState)
+
+	filepath.Walk(kFilesDir, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != kFilesDir && strings.HasPrefix(fileInfo.Name(), ".") {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fileInfo.Mode().IsRegular() {
+			relative, _ := filepath.Rel(kFilesDir, path)
+			current[filepath.ToSlash(relative)] = fileState{fileInfo.Size(), fileInfo.ModTime()}
+		}
+		return nil
+	})
+
+	events := make([]ChangeEvent, 0)
+
+	for name, state := range current {
+		previous, existed := feed.known[name]
+		if !existed {
+			events = append(events, ChangeEvent{Kind: kEventCreated, Name: name, Size: state.size})
+		} else if previous != state {
+			events = append(events, ChangeEvent{Kind: kEventModified, Name: name, Size: state.size})
+		}
+	}
+
+	for name := range feed.known {
+		if _, exists := current[name]; !exists {
+			events = append(events, ChangeEvent{Kind: kEventDeleted, Name: name})
+		}
+	}
+
+	feed.known = current
+
+	if !publish {
+		return
+	}
+
+	for i := 0; i < len(events); i++ {
+		if events[i].Kind != kEventDeleted {
+			events[i].Checksum, _ = FileChecksum(StorePath(events[i].Name))
+		}
+		feed.publish(events[i])
+	}
+
+}
+
+func (feed *ChangeFeed) publish(event ChangeEvent) {
+
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	for events := range feed.subscribers {
+		select {
+		case events <- event:
+		default:
+			// A subscriber this far behind has stopped reading; drop it
+			// rather than stall everyone else.
+			delete(feed.subscribers, events)
+			close(events)
+		}
+	}
+
+}
+
+// watchDirectory calls changed whenever something under root may have
+// changed, forever, leaving the feed's rescan to find out what. Without
+// inotify it polls.
+func watchDirectory(root string, changed func()) {
+
+	err := common.WatchDirectory(root, changed)
+	if err != common.ErrWatchUnsupported {
+		Log.Warn("inotify failed, polling for changes", "error", err)
+	}
+	common.PollDirectory(root, changed)
+
+}
+
+// WatchMatches reports whether name lies under the watched path, which may
+// name a single file, a directory, or be empty for everything.
+func WatchMatches(path string, name string) bool {
+	path = strings.TrimSuffix(path, "/")
+	return path == "" || name == path || strings.HasPrefix(name, path+"/")
+}
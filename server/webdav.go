@@ -0,0 +1,580 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// kDefaultLockTimeout is how long a lock lasts if LOCK gives no
+	// Timeout; kMaxLockTimeout caps what it may ask for.
+	kDefaultLockTimeout = time.Hour
+	kMaxLockTimeout     = 24 * time.Hour
+)
+
+// WebDAVAddr is the address of the optional WebDAV listener, which presents
+// the files directory as a network drive, with the options of -listen. It
+// is disabled if empty.
+var (
+	WebDAVAddr     string
+	WebDAVListener *Listener
+)
+
+// davLock is a write lock granted to a WebDAV client.
+type davLock struct {
+	token   string
+	expires time.Time
+}
+
+// davLocks holds the unexpired locks by the name they were taken on.
+var (
+	davLocks     = make(map[string]davLock)
+	davLockMutex sync.Mutex
+)
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string           `xml:"D:displayname"`
+	ResourceType  davResourceType  `xml:"D:resourcetype"`
+	ContentLength string           `xml:"D:getcontentlength,omitempty"`
+	LastModified  string           `xml:"D:getlastmodified"`
+	ETag          string           `xml:"D:getetag,omitempty"`
+	SupportedLock davSupportedLock `xml:"D:supportedlock"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+type davSupportedLock struct {
+	Entry davLockEntry `xml:"D:lockentry"`
+}
+
+type davLockEntry struct {
+	Scope davLockScope `xml:"D:lockscope"`
+	Type  davLockType  `xml:"D:locktype"`
+}
+
+type davLockScope struct {
+	Exclusive struct{} `xml:"D:exclusive"`
+}
+
+type davLockType struct {
+	Write struct{} `xml:"D:write"`
+}
+
+// WebDAVHandler serves the files directory over WebDAV class 2, sharing the
+// storage layer, confinement, hooks, logging and audit of the TCP protocol.
+// Locks are enforced against other WebDAV requests only. A read-only
+// handler refuses every change.
+type WebDAVHandler struct {
+	ReadOnly bool
+}
+
+func (handler WebDAVHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+
+	conn := NewConnInfo(request.RemoteAddr)
+	ServerMetrics.ConnectionOpened()
+	defer ServerMetrics.ConnectionClosed()
+
+	name, valid := JailPath(strings.TrimPrefix(request.URL.Path, "/"))
+	if !valid {
+		conn.RecordRequest(request.Method, request.URL.Path, "reqerr", 0, "", time.Now())
+		http.Error(response, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if IsReservedName(name) {
+		conn.RecordRequest(request.Method, name, "notfound", 0, "", time.Now())
+		http.NotFound(response, request)
+		return
+	}
+
+	readOnly := handler.ReadOnly || Primary != "" || Upstream != ""
+	writing := request.Method == "PUT" || request.Method == "DELETE" || request.Method == "MOVE" || request.Method == "MKCOL"
+	if readOnly && writing {
+		conn.RecordRequest(request.Method, name, "rejected", 0, "", time.Now())
+		http.Error(response, ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+	if writing && lockedOut(request, name) {
+		conn.RecordRequest(request.Method, name, "locked", 0, "", time.Now())
+		http.Error(response, "locked", http.StatusLocked)
+		return
+	}
+
+	switch request.Method {
+	case "OPTIONS":
+		response.Header().Set("DAV", "1, 2")
+		response.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MOVE, MKCOL, LOCK, UNLOCK")
+		response.Header().Set("MS-Author-Via", "DAV")
+	case "PROPFIND":
+		handler.propfind(response, request, conn, name)
+	case "GET", "HEAD":
+		HTTPGateway{}.get(response, request, conn, name)
+	case "PUT":
+		HTTPGateway{}.put(response, request, conn, name)
+	case "DELETE":
+		handler.delete(response, conn, name)
+	case "MKCOL":
+		handler.mkcol(response, conn, name)
+	case "MOVE":
+		handler.move(response, request, conn, name)
+	case "LOCK":
+		handler.lock(response, request, conn, name)
+	case "UNLOCK":
+		handler.unlock(response, request, conn, name)
+	default:
+		conn.RecordRequest(request.Method, name, "reqerr", 0, "", time.Now())
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+	}
+
+}
+
+// davHref is the URL path of name, escaped segment by segment.
+func davHref(name string, collection bool) string {
+
+	segments := strings.Split(name, "/")
+	for i := 0; i < len(segments); i++ {
+		segments[i] = url.PathEscape(segments[i])
+	}
+
+	href := "/" + strings.Join(segments, "/")
+	if collection && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+
+}
+
+func davEntry(name string, fileInfo os.FileInfo) davResponse {
+
+	prop := davProp{
+		DisplayName:  fileInfo.Name(),
+		LastModified: fileInfo.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if fileInfo.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		prop.ContentLength = strconv.FormatInt(fileInfo.Size(), 10)
+		if checksum, found := Hashes.Lookup(StorePath(name), fileInfo); found {
+			prop.ETag = "\"" + checksum + "\""
+		}
+	}
+
+	return davResponse{
+		Href:     davHref(name, fileInfo.IsDir()),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+
+}
+
+// propfind describes name and, unless Depth is 0, its visible children. All
+// properties are returned whatever the request body asks for.
+func (handler WebDAVHandler) propfind(response http.ResponseWriter, request *http.Request, conn *ConnInfo, name string) {
+
+	start := time.Now()
+	localFile := StorePath(name)
+
+	fileInfo, err := os.Stat(localFile)
+	if err != nil {
+		conn.RecordRequest("PROPFIND", name, "notfound", 0, "", start)
+		http.NotFound(response, request)
+		return
+	}
+
+	responses := []davResponse{davEntry(name, fileInfo)}
+
+	if fileInfo.IsDir() && request.Header.Get("Depth") != "0" {
+
+		children, err := ioutil.ReadDir(localFile)
+		if err != nil {
+			conn.Log.Error("directory listing error", "dir", localFile, "error", err)
+			conn.RecordRequest("PROPFIND", name, "readerr", 0, "", start)
+			http.Error(response, "cannot list directory", http.StatusInternalServerError)
+			return
+		}
+
+		for i := 0; i < len(children); i++ {
+			if strings.HasPrefix(children[i].Name(), ".") {
+				continue
+			}
+			responses = append(responses, davEntry(strings.TrimPrefix(name+"/"+children[i].Name(), "/"), children[i]))
+		}
+
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName   xml.Name      `xml:"D:multistatus"`
+		Namespace string        `xml:"xmlns:D,attr"`
+		Responses []davResponse `xml:"D:response"`
+	}{Namespace: "DAV:", Responses: responses})
+
+	response.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	response.WriteHeader(http.StatusMultiStatus)
+	response.Write([]byte(xml.Header))
+	response.Write(body)
+
+	conn.RecordRequest("PROPFIND", name, "ok", int64(len(body)), "", start)
+
+}
+
+// delete removes a file, or a directory and everything in it. Files go to
+// the trash when it is enabled, as with the DELETE verb.
+func (handler WebDAVHandler) delete(response http.ResponseWriter, conn *ConnInfo, name string) {
+
+	start := time.Now()
+	localFile := StorePath(name)
+
+	if name == "" {
+		conn.RecordRequest("DELETE", name, "reqerr", 0, "", start)
+		http.Error(response, "cannot delete the root", http.StatusForbidden)
+		return
+	}
+
+	fileInfo, err := os.Lstat(localFile)
+	if err != nil {
+		conn.RecordRequest("DELETE", name, "notfound", 0, "", start)
+		http.Error(response, "not found", http.StatusNotFound)
+		return
+	}
+
+	if fileInfo.IsDir() {
+		err = DeleteTree(name)
+	} else {
+		err = DeleteFile(name)
+	}
+
+	if err == ErrNotEmpty {
+		conn.RecordRequest("DELETE", name, "conflict", 0, "", start)
+		http.Error(response, "changed while deleting", http.StatusConflict)
+		return
+	} else if err != nil {
+		conn.Log.Error("error deleting", "file", name, "error", err)
+		conn.RecordRequest("DELETE", name, "wrerr", 0, "", start)
+		http.Error(response, "cannot delete", http.StatusInternalServerError)
+		return
+	}
+
+	releaseLocks(name)
+	conn.RecordRequest("DELETE", name, "ok", 0, "", start)
+	response.WriteHeader(http.StatusNoContent)
+
+}
+
+func (handler WebDAVHandler) mkcol(response http.ResponseWriter, conn *ConnInfo, name string) {
+
+	start := time.Now()
+
+	err := os.Mkdir(StorePath(name), 0755)
+	if os.IsExist(err) || name == "" {
+		conn.RecordRequest("MKCOL", name, "exists", 0, "", start)
+		http.Error(response, "already exists", http.StatusMethodNotAllowed)
+		return
+	} else if os.IsNotExist(err) {
+		conn.RecordRequest("MKCOL", name, "notfound", 0, "", start)
+		http.Error(response, "parent does not exist", http.StatusConflict)
+		return
+	} else if err != nil {
+		conn.Log.Error("error creating directory", "dir", name, "error", err)
+		conn.RecordRequest("MKCOL", name, "wrerr", 0, "", start)
+		http.Error(response, "cannot create directory", http.StatusInternalServerError)
+		return
+	}
+
+	conn.RecordRequest("MKCOL", name, "ok", 0, "", start)
+	response.WriteHeader(http.StatusCreated)
+
+}
+
+// move renames name to the path in the Destination header. Overwrite: F
+// refuses to replace anything already there. A directory cannot be moved
+// onto itself or into itself, and the destination's locks apply as well.
+func (handler WebDAVHandler) move(response http.ResponseWriter, request *http.Request, conn *ConnInfo, name string) {
+
+	start := time.Now()
+
+	if name == "" {
+		conn.RecordRequest("MOVE", name, "reqerr", 0, "", start)
+		http.Error(response, "cannot move the root", http.StatusForbidden)
+		return
+	}
+
+	destination, err := url.Parse(request.Header.Get("Destination"))
+	if err != nil || destination.Path == "" {
+		conn.RecordRequest("MOVE", name, "reqerr", 0, "", start)
+		http.Error(response, "invalid destination", http.StatusBadRequest)
+		return
+	}
+
+	target, valid := JailPath(strings.TrimPrefix(destination.Path, "/"))
+	if !valid || target == "" || IsReservedName(target) || target == name || strings.HasPrefix(target, name+"/") {
+		conn.RecordRequest("MOVE", name, "reqerr", 0, "", start)
+		http.Error(response, "invalid destination", http.StatusForbidden)
+		return
+	}
+	if lockedOut(request, target) {
+		conn.RecordRequest("MOVE", name, "locked", 0, "", start)
+		http.Error(response, "destination is locked", http.StatusLocked)
+		return
+	}
+
+	_, existed := os.Lstat(StorePath(target))
+
+	err = MoveFile(name, target, request.Header.Get("Overwrite") != "F")
+	switch {
+	case err == ErrNotFound:
+		conn.RecordRequest("MOVE", name, "notfound", 0, "", start)
+		http.Error(response, "not found", http.StatusNotFound)
+	case err == ErrExists:
+		conn.RecordRequest("MOVE", name, "exists", 0, "", start)
+		http.Error(response, "destination exists", http.StatusPreconditionFailed)
+	case err != nil:
+		conn.Log.Error("error moving file", "file", name, "destination", target, "error", err)
+		conn.RecordRequest("MOVE", name, "wrerr", 0, "", start)
+		http.Error(response, "cannot move", http.StatusInternalServerError)
+	case existed == nil:
+		releaseLocks(name)
+		releaseLocks(target)
+		conn.RecordRequest("MOVE", name+" -> "+target, "ok", 0, "", start)
+		response.WriteHeader(http.StatusNoContent)
+	default:
+		releaseLocks(name)
+		conn.RecordRequest("MOVE", name+" -> "+target, "ok", 0, "", start)
+		response.WriteHeader(http.StatusCreated)
+	}
+
+}
+
+// lock grants an exclusive write lock on name, or refreshes the lock whose
+// token the request carries. A name that already holds, or has below it, a
+// lock the request does not carry the token of answers 423.
+func (handler WebDAVHandler) lock(response http.ResponseWriter, request *http.Request, conn *ConnInfo, name string) {
+
+	start := time.Now()
+	timeout := lockTimeout(request.Header.Get("Timeout"))
+	tokens := submittedTokens(request)
+
+	davLockMutex.Lock()
+	if lockedByOthers(name, tokens) {
+		davLockMutex.Unlock()
+		conn.RecordRequest("LOCK", name, "locked", 0, "", start)
+		http.Error(response, "locked", http.StatusLocked)
+		return
+	}
+	lock, found := davLocks[name]
+	if !found || !tokens[lock.token] {
+		lock.token = newLockToken()
+	}
+	lock.expires = start.Add(timeout)
+	davLocks[name] = lock
+	davLockMutex.Unlock()
+
+	response.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	response.Header().Set("Lock-Token", "<"+lock.token+">")
+	response.WriteHeader(http.StatusOK)
+	response.Write([]byte(xml.Header + `<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>` +
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:depth>0</D:depth><D:timeout>Second-` + strconv.Itoa(int(timeout.Seconds())) + `</D:timeout>` +
+		`<D:locktoken><D:href>` + lock.token + `</D:href></D:locktoken>` +
+		`<D:lockroot><D:href>` + davHref(name, false) + `</D:href></D:lockroot>` +
+		`</D:activelock></D:lockdiscovery></D:prop>`))
+
+	conn.RecordRequest("LOCK", name, "ok", 0, "", start)
+
+}
+
+// unlock releases the lock on name named by the Lock-Token header.
+func (handler WebDAVHandler) unlock(response http.ResponseWriter, request *http.Request, conn *ConnInfo, name string) {
+
+	start := time.Now()
+	token := strings.Trim(strings.TrimSpace(request.Header.Get("Lock-Token")), "<>")
+
+	davLockMutex.Lock()
+	lock, found := davLocks[name]
+	if found && lock.token == token {
+		delete(davLocks, name)
+	}
+	davLockMutex.Unlock()
+
+	if !found || lock.token != token {
+		conn.RecordRequest("UNLOCK", name, "conflict", 0, "", start)
+		http.Error(response, "no such lock", http.StatusConflict)
+		return
+	}
+
+	conn.RecordRequest("UNLOCK", name, "ok", 0, "", start)
+	response.WriteHeader(http.StatusNoContent)
+
+}
+
+// lockTimeout reads the first Second-<n> of a Timeout header, capped at
+// kMaxLockTimeout. Anything else, including Infinite, gets the default.
+func lockTimeout(header string) time.Duration {
+
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if !strings.HasPrefix(value, "Second-") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.TrimPrefix(value, "Second-"), 10, 64)
+		if err != nil || seconds <= 0 {
+			continue
+		}
+		if seconds > int64(kMaxLockTimeout/time.Second) {
+			return kMaxLockTimeout
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	return kDefaultLockTimeout
+
+}
+
+func newLockToken() string {
+	random := make([]byte, 16)
+	rand.Read(random)
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", random[0:4], random[4:6], random[6:8], random[8:10], random[10:])
+}
+
+// submittedTokens collects the lock tokens a request carries in its If
+// header, such as (<opaquelocktoken:...>), whatever the resource tags.
+func submittedTokens(request *http.Request) map[string]bool {
+
+	tokens := make(map[string]bool)
+	fields := strings.FieldsFunc(request.Header.Get("If"), func(r rune) bool {
+		return r == '<' || r == '>'
+	})
+	for i := 0; i < len(fields); i++ {
+		if strings.HasPrefix(fields[i], "opaquelocktoken:") {
+			tokens[fields[i]] = true
+		}
+	}
+	return tokens
+
+}
+
+// lockedByOthers reports whether name, or anything below it, holds a lock
+// whose token is not in tokens. Expired locks are dropped on the way.
+// Callers hold davLockMutex.
+func lockedByOthers(name string, tokens map[string]bool) bool {
+
+	now := time.Now()
+	for locked, lock := range davLocks {
+		if now.After(lock.expires) {
+			delete(davLocks, locked)
+			continue
+		}
+		below := name == "" || locked == name || strings.HasPrefix(locked, name+"/")
+		if below && !tokens[lock.token] {
+			return true
+		}
+	}
+	return false
+
+}
+
+// lockedOut reports whether a write of name must be refused for a lock the
+// request does not carry the token of.
+func lockedOut(request *http.Request, name string) bool {
+	tokens := submittedTokens(request)
+	davLockMutex.Lock()
+	defer davLockMutex.Unlock()
+	return lockedByOthers(name, tokens)
+}
+
+// releaseLocks drops the locks on name and below it, once it is gone.
+func releaseLocks(name string) {
+	davLockMutex.Lock()
+	for locked := range davLocks {
+		if locked == name || strings.HasPrefix(locked, name+"/") {
+			delete(davLocks, locked)
+		}
+	}
+	davLockMutex.Unlock()
+}
+
+// ServeWebDAV runs the WebDAV share on netListener, bound for listener,
+// until it fails.
+func ServeWebDAV(listener *Listener, netListener net.Listener) {
+
+	Log.Info("serving WebDAV", "address", listener.String(), "tls", listener.TLS, "readonly", listener.ReadOnly)
+	err := http.Serve(netListener, WebDAVHandler{ReadOnly: listener.ReadOnly})
+	Log.Error("WebDAV listener stopped", "error", err)
+
+}
+
+// ErrNotEmpty is returned by DeleteTree when something was created in the
+// tree while it was being deleted.
+var ErrNotEmpty = errors.New("directory is not empty")
+
+// DeleteTree deletes every file below the directory name, each as DeleteFile
+// would, then removes the emptied directories. Directories that are no
+// longer empty, because something was created in them meanwhile, are left
+// alone and ErrNotEmpty is returned, so nothing bypasses the trash.
+func DeleteTree(name string) error {
+
+	root := StorePath(name)
+	files := make([]string, 0)
+	dirs := make([]string, 0)
+
+	err := filepath.Walk(root, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(kFilesDir, path)
+		if fileInfo.IsDir() {
+			dirs = append(dirs, path)
+		} else {
+			files = append(files, filepath.ToSlash(relative))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(files); i++ {
+		err = DeleteFile(files[i])
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	// Deepest first, so each directory is empty by the time it is removed.
+	var result error
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = os.Remove(dirs[i])
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		entries, readErr := ioutil.ReadDir(dirs[i])
+		if readErr != nil || len(entries) == 0 {
+			return err
+		}
+		result = ErrNotEmpty
+	}
+
+	return result
+
+}
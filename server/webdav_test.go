@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chdirStore runs a test in an empty directory with a files directory in it,
+// as the server expects to find in its working directory.
+func chdirStore(t *testing.T) string {
+
+	dir := t.TempDir()
+	err := os.Mkdir(filepath.Join(dir, kFilesDir), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	davLocks = make(map[string]davLock)
+	t.Cleanup(func() {
+		os.Chdir(previous)
+		TrashRetention = 0
+	})
+
+	return dir
+
+}
+
+// dav sends one request to the WebDAV handler. headers are name, value
+// pairs.
+func dav(method string, target string, body string, headers ...string) *httptest.ResponseRecorder {
+
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+
+	recorder := httptest.NewRecorder()
+	WebDAVHandler{}.ServeHTTP(recorder, request)
+	return recorder
+
+}
+
+func expectStatus(t *testing.T, recorder *httptest.ResponseRecorder, status int, what string) {
+	t.Helper()
+	if recorder.Code != status {
+		t.Fatalf("%s: got status %d, want %d (%s)", what, recorder.Code, status, strings.TrimSpace(recorder.Body.String()))
+	}
+}
+
+func expectFile(t *testing.T, path string, contents string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	if string(data) != contents {
+		t.Fatalf("%s: got %q, want %q", path, data, contents)
+	}
+}
+
+func TestWebDAVRoundTrip(t *testing.T) {
+
+	chdirStore(t)
+
+	expectStatus(t, dav("MKCOL", "/docs", ""), http.StatusCreated, "MKCOL")
+	expectStatus(t, dav("PUT", "/docs/a.txt", "hello"), http.StatusCreated, "PUT")
+
+	get := dav("GET", "/docs/a.txt", "")
+	expectStatus(t, get, http.StatusOK, "GET")
+	if get.Body.String() != "hello" {
+		t.Fatalf("GET: got %q", get.Body.String())
+	}
+
+	list := dav("PROPFIND", "/docs", "", "Depth", "1")
+	expectStatus(t, list, http.StatusMultiStatus, "PROPFIND")
+	if !strings.Contains(list.Body.String(), "<D:href>/docs/a.txt</D:href>") {
+		t.Fatalf("PROPFIND does not list the file: %s", list.Body.String())
+	}
+
+	expectStatus(t, dav("MOVE", "/docs/a.txt", "", "Destination", "http://example.com/b.txt"), http.StatusCreated, "MOVE")
+	expectFile(t, filepath.Join(kFilesDir, "b.txt"), "hello")
+
+	expectStatus(t, dav("DELETE", "/docs", ""), http.StatusNoContent, "DELETE")
+	if _, err := os.Stat(filepath.Join(kFilesDir, "docs")); !os.IsNotExist(err) {
+		t.Fatalf("directory survived DELETE: %v", err)
+	}
+
+}
+
+func TestWebDAVTraversal(t *testing.T) {
+
+	dir := chdirStore(t)
+	ioutil.WriteFile(filepath.Join(dir, "outside.txt"), []byte("secret"), 0644)
+	ioutil.WriteFile(filepath.Join(kFilesDir, "inside.txt"), []byte("kept"), 0644)
+
+	targets := []string{"/..", "/../", "/../outside.txt", "/%2e%2e", "/%2e%2e/outside.txt", "/a/../../outside.txt", "/..%2foutside.txt"}
+	methods := []string{"PROPFIND", "GET", "PUT", "DELETE", "MKCOL", "MOVE", "LOCK"}
+
+	for _, target := range targets {
+		for _, method := range methods {
+			recorder := dav(method, target, "overwritten", "Destination", "/moved", "Depth", "1")
+			expectStatus(t, recorder, http.StatusBadRequest, method+" "+target)
+			if strings.Contains(recorder.Body.String(), "outside.txt") {
+				t.Fatalf("%s %s leaked a listing of the parent directory", method, target)
+			}
+		}
+	}
+
+	for _, destination := range []string{"/..", "/../outside.txt", "http://example.com/%2e%2e/outside.txt"} {
+		recorder := dav("MOVE", "/inside.txt", "", "Destination", destination)
+		expectStatus(t, recorder, http.StatusForbidden, "MOVE to "+destination)
+	}
+
+	expectFile(t, filepath.Join(dir, "outside.txt"), "secret")
+	expectFile(t, filepath.Join(kFilesDir, "inside.txt"), "kept")
+
+}
+
+func TestWebDAVRootRefused(t *testing.T) {
+
+	chdirStore(t)
+	ioutil.WriteFile(filepath.Join(kFilesDir, "a.txt"), []byte("kept"), 0644)
+
+	expectStatus(t, dav("DELETE", "/", ""), http.StatusForbidden, "DELETE /")
+	expectStatus(t, dav("MOVE", "/", "", "Destination", "/elsewhere"), http.StatusForbidden, "MOVE /")
+	expectStatus(t, dav("MOVE", "/a.txt", "", "Destination", "/"), http.StatusForbidden, "MOVE onto /")
+
+	expectFile(t, filepath.Join(kFilesDir, "a.txt"), "kept")
+
+}
+
+func TestWebDAVMoveIntoItself(t *testing.T) {
+
+	chdirStore(t)
+	os.MkdirAll(filepath.Join(kFilesDir, "d"), 0755)
+	ioutil.WriteFile(filepath.Join(kFilesDir, "d", "f"), []byte("kept"), 0644)
+
+	expectStatus(t, dav("MOVE", "/d", "", "Destination", "/d"), http.StatusForbidden, "MOVE onto itself")
+	expectStatus(t, dav("MOVE", "/d", "", "Destination", "/d/sub"), http.StatusForbidden, "MOVE into itself")
+
+	expectFile(t, filepath.Join(kFilesDir, "d", "f"), "kept")
+
+}
+
+func TestWebDAVMoveOverDirectoryUsesTrash(t *testing.T) {
+
+	chdirStore(t)
+	TrashRetention = time.Hour
+
+	os.MkdirAll(filepath.Join(kFilesDir, "d"), 0755)
+	ioutil.WriteFile(filepath.Join(kFilesDir, "d", "f"), []byte("old"), 0644)
+	ioutil.WriteFile(filepath.Join(kFilesDir, "g"), []byte("new"), 0644)
+
+	expectStatus(t, dav("MOVE", "/g", "", "Destination", "/d"), http.StatusNoContent, "MOVE over directory")
+	expectFile(t, filepath.Join(kFilesDir, "d"), "new")
+
+	entries, err := ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "d/f" {
+		t.Fatalf("trash holds %v, want d/f", entries)
+	}
+
+}
+
+func TestWebDAVLocks(t *testing.T) {
+
+	chdirStore(t)
+	expectStatus(t, dav("MKCOL", "/d", ""), http.StatusCreated, "MKCOL")
+	expectStatus(t, dav("PUT", "/d/a.txt", "one"), http.StatusCreated, "PUT")
+
+	lock := dav("LOCK", "/d/a.txt", "", "Timeout", "Second-60")
+	expectStatus(t, lock, http.StatusOK, "LOCK")
+	token := strings.Trim(lock.Header().Get("Lock-Token"), "<>")
+	if !strings.HasPrefix(token, "opaquelocktoken:") {
+		t.Fatalf("LOCK returned token %q", token)
+	}
+	held := "(<" + token + ">)"
+
+	expectStatus(t, dav("LOCK", "/d/a.txt", ""), http.StatusLocked, "second LOCK")
+	expectStatus(t, dav("PUT", "/d/a.txt", "two"), http.StatusLocked, "PUT without token")
+	expectStatus(t, dav("DELETE", "/d/a.txt", ""), http.StatusLocked, "DELETE without token")
+	expectStatus(t, dav("DELETE", "/d", ""), http.StatusLocked, "DELETE of parent without token")
+	expectStatus(t, dav("MOVE", "/d/a.txt", "", "Destination", "/b.txt"), http.StatusLocked, "MOVE without token")
+	expectFile(t, filepath.Join(kFilesDir, "d", "a.txt"), "one")
+
+	expectStatus(t, dav("PUT", "/d/a.txt", "two", "If", "<http://example.com/d/a.txt> "+held), http.StatusCreated, "PUT with token")
+	expectFile(t, filepath.Join(kFilesDir, "d", "a.txt"), "two")
+
+	refresh := dav("LOCK", "/d/a.txt", "", "If", held)
+	expectStatus(t, refresh, http.StatusOK, "refresh")
+	if refresh.Header().Get("Lock-Token") != "<"+token+">" {
+		t.Fatalf("refresh changed the token to %s", refresh.Header().Get("Lock-Token"))
+	}
+
+	expectStatus(t, dav("UNLOCK", "/d/a.txt", "", "Lock-Token", "<opaquelocktoken:wrong>"), http.StatusConflict, "UNLOCK with wrong token")
+	expectStatus(t, dav("UNLOCK", "/d/a.txt", "", "Lock-Token", "<"+token+">"), http.StatusNoContent, "UNLOCK")
+	expectStatus(t, dav("PUT", "/d/a.txt", "three"), http.StatusCreated, "PUT after UNLOCK")
+
+	davLocks["d/a.txt"] = davLock{token: "opaquelocktoken:expired", expires: time.Now().Add(-time.Second)}
+	expectStatus(t, dav("DELETE", "/d", ""), http.StatusNoContent, "DELETE after expiry")
+
+}